@@ -0,0 +1,370 @@
+package proxima
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// recentFailures is the number of failures kept per proxy.
+const recentFailures = 10
+
+// maxClauseSize is the maximum size of a clause to assert or retract.
+const maxClauseSize = 1 << 20
+
+// progressInterval is how often the number of bytes of tunnels in progress is updated.
+var progressInterval = time.Second
+
+// Admin keeps track of live tunnels and the state of proxies, and serves them as an HTTP API protected by Token.
+type Admin struct {
+	// Token is the bearer token required for every request. If empty, every request is rejected.
+	Token string
+
+	// Facts serves the endpoints to change dynamic predicates if set.
+	Facts Facts
+
+	mu       sync.Mutex
+	tunnels  map[xid.ID]*liveTunnel
+	drained  map[string]bool
+	failures map[string][]Failure
+	exitIPs  map[string]exitIP
+
+	nextSweep time.Time
+}
+
+// NewAdmin returns a new Admin which accepts requests with token.
+func NewAdmin(token string) *Admin {
+	return &Admin{
+		Token:    token,
+		tunnels:  map[xid.ID]*liveTunnel{},
+		drained:  map[string]bool{},
+		failures: map[string][]Failure{},
+		exitIPs:  map[string]exitIP{},
+	}
+}
+
+// LiveTunnel describes a tunnel in progress.
+type LiveTunnel struct {
+	ID       xid.ID    `json:"rid"`
+	Remote   string    `json:"remote"`
+	Target   string    `json:"target"`
+	User     string    `json:"user,omitempty"`
+	Proxy    string    `json:"proxy"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+	Start    time.Time `json:"start"`
+	// Age is the number of seconds since Start.
+	Age float64 `json:"age"`
+}
+
+// Failure describes a failed attempt to connect via a proxy.
+type Failure struct {
+	ID     xid.ID    `json:"rid"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// ProxyState describes the state of a proxy.
+type ProxyState struct {
+	Proxy    string    `json:"proxy"`
+	Drained  bool      `json:"drained"`
+	ExitIP   string    `json:"exit_ip,omitempty"`
+	Failures []Failure `json:"failures"`
+}
+
+type liveTunnel struct {
+	info   LiveTunnel
+	splice *splice
+}
+
+// open registers the tunnel in progress and returns a function to unregister it.
+func (a *Admin) open(info LiveTunnel, s *splice) func() {
+	if a == nil {
+		return func() {}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tunnels[info.ID] = &liveTunnel{info: info, splice: s}
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.tunnels, info.ID)
+	}
+}
+
+// Tunnels returns the tunnels in progress, oldest first.
+func (a *Admin) Tunnels() []LiveTunnel {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	ts := make([]LiveTunnel, 0, len(a.tunnels))
+	for _, t := range a.tunnels {
+		info := t.info
+		info.Sent, info.Received = t.splice.progress()
+		info.Age = now.Sub(info.Start).Seconds()
+		ts = append(ts, info)
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].Start.Before(ts[j].Start)
+	})
+	return ts
+}
+
+// Kill closes the tunnel of the request ID. It returns false if there's no such tunnel.
+func (a *Admin) Kill(id xid.ID) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	t, ok := a.tunnels[id]
+	a.mu.Unlock()
+	if !ok {
+		return false
+	}
+	t.splice.kill()
+	return true
+}
+
+// Drain makes Switchers skip the proxy for new requests if drained is true, or use it again otherwise.
+func (a *Admin) Drain(proxy string, drained bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if drained {
+		a.drained[proxy] = true
+	} else {
+		delete(a.drained, proxy)
+	}
+}
+
+// Drained reports whether the proxy is drained.
+func (a *Admin) Drained(proxy string) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.drained[proxy]
+}
+
+func (a *Admin) failure(proxy string, f Failure) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sweep(f.Time)
+	fs := append(a.failures[proxy], f)
+	if len(fs) > recentFailures {
+		fs = fs[len(fs)-recentFailures:]
+	}
+	a.failures[proxy] = fs
+}
+
+func (a *Admin) exitIP(proxy, ip string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	a.sweep(now)
+	a.exitIPs[proxy] = exitIP{ip: ip, last: now}
+}
+
+// sweep removes the failures and the exit IPs of the proxies idle for idleProxyTTL once in a while. It must be called
+// with a.mu held.
+func (a *Admin) sweep(now time.Time) {
+	if now.Before(a.nextSweep) {
+		return
+	}
+	a.nextSweep = now.Add(sweepInterval)
+
+	for p, fs := range a.failures {
+		if now.Sub(fs[len(fs)-1].Time) >= idleProxyTTL {
+			delete(a.failures, p)
+		}
+	}
+	for p, x := range a.exitIPs {
+		if now.Sub(x.last) >= idleProxyTTL {
+			delete(a.exitIPs, p)
+		}
+	}
+}
+
+// Proxies returns the states of proxies which are drained, have failed recently, or have known exit IPs, sorted by
+// name.
+// Failures are listed oldest first.
+func (a *Admin) Proxies() []ProxyState {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	names := map[string]struct{}{}
+	for p := range a.drained {
+		names[p] = struct{}{}
+	}
+	for p := range a.failures {
+		names[p] = struct{}{}
+	}
+	for p := range a.exitIPs {
+		names[p] = struct{}{}
+	}
+
+	ps := make([]ProxyState, 0, len(names))
+	for p := range names {
+		ps = append(ps, ProxyState{
+			Proxy:    p,
+			Drained:  a.drained[p],
+			ExitIP:   a.exitIPs[p].ip,
+			Failures: append([]Failure{}, a.failures[p]...),
+		})
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Proxy < ps[j].Proxy
+	})
+	return ps
+}
+
+// ServeHTTP serves the admin API:
+//
+//	GET    /tunnels                      lists tunnels in progress
+//	DELETE /tunnels/{rid}                kills the tunnel of the request ID
+//	GET    /proxies                      lists drained proxies, exit IPs, and recent failures
+//	POST   /proxies/drain?proxy={proxy}   drains the proxy
+//	POST   /proxies/undrain?proxy={proxy} undrains the proxy
+//	GET    /facts                        dumps the dynamic predicates
+//	POST   /facts/assert                 asserts the clause in the body
+//	POST   /facts/retract                retracts the clause in the body
+//
+// Every request must have the header Authorization: Bearer {Token}.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="proxima"`)
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	switch path := r.URL.Path; {
+	case path == "/tunnels":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, a.Tunnels())
+	case strings.HasPrefix(path, "/tunnels/"):
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		id, err := xid.FromString(strings.TrimPrefix(path, "/tunnels/"))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if !a.Kill(id) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/proxies":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, a.Proxies())
+	case path == "/proxies/drain", path == "/proxies/undrain":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		proxy := r.URL.Query().Get("proxy")
+		if proxy == "" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		a.Drain(proxy, path == "/proxies/drain")
+		w.WriteHeader(http.StatusNoContent)
+	case a.Facts == nil:
+		http.NotFound(w, r)
+	case path == "/facts":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		var b bytes.Buffer
+		if err := a.Facts.Dump(r.Context(), &b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = b.WriteTo(w)
+	case path == "/facts/assert", path == "/facts/retract":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		clause, err := ioutil.ReadAll(io.LimitReader(r.Body, maxClauseSize))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		change := a.Facts.Assert
+		if path == "/facts/retract" {
+			change = a.Facts.Retract
+		}
+		switch err := change(r.Context(), string(clause)); {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, errInvalidClause):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, errNoClause):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	if a == nil || a.Token == "" {
+		return false
+	}
+	const bearer = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, bearer) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(h, bearer)), []byte(a.Token)) == 1
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, "", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
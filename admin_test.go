@@ -0,0 +1,110 @@
+package proxima
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin_ServeHTTP(t *testing.T) {
+	request := func(a *Admin, method, target, token string, body ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(strings.Join(body, "")))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		a := NewAdmin("secret")
+		assert.Equal(t, http.StatusUnauthorized, request(a, http.MethodGet, "/tunnels", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, request(a, http.MethodGet, "/tunnels", "wrong").Code)
+		assert.Equal(t, http.StatusUnauthorized, request(NewAdmin(""), http.MethodGet, "/tunnels", "").Code)
+	})
+
+	t.Run("tunnels", func(t *testing.T) {
+		a := NewAdmin("secret")
+		w := request(a, http.MethodGet, "/tunnels", "secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "[]\n", w.Body.String())
+
+		assert.Equal(t, http.StatusNotFound, request(a, http.MethodDelete, "/tunnels/"+xid.New().String(), "secret").Code)
+		assert.Equal(t, http.StatusBadRequest, request(a, http.MethodDelete, "/tunnels/foo", "secret").Code)
+		assert.Equal(t, http.StatusMethodNotAllowed, request(a, http.MethodPost, "/tunnels", "secret").Code)
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		a := NewAdmin("secret")
+		assert.Equal(t, http.StatusNoContent, request(a, http.MethodPost, "/proxies/drain?proxy=http://localhost:8081", "secret").Code)
+		assert.True(t, a.Drained("http://localhost:8081"))
+
+		w := request(a, http.MethodGet, "/proxies", "secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var ps []ProxyState
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ps))
+		assert.Equal(t, []ProxyState{{Proxy: "http://localhost:8081", Drained: true, Failures: []Failure{}}}, ps)
+
+		assert.Equal(t, http.StatusNoContent, request(a, http.MethodPost, "/proxies/undrain?proxy=http://localhost:8081", "secret").Code)
+		assert.False(t, a.Drained("http://localhost:8081"))
+
+		assert.Equal(t, http.StatusBadRequest, request(a, http.MethodPost, "/proxies/drain", "secret").Code)
+	})
+
+	t.Run("recent failures", func(t *testing.T) {
+		s := Switcher{Admin: NewAdmin("secret")}
+		for i := 0; i < recentFailures+2; i++ {
+			s.failure(xid.New(), &proxy{name: "http://localhost:8081", label: "http://localhost:8081"}, FailureDial, errors.New("connection refused"))
+		}
+
+		ps := s.Admin.Proxies()
+		assert.Len(t, ps, 1)
+		assert.False(t, ps[0].Drained)
+		assert.Len(t, ps[0].Failures, recentFailures)
+		assert.Equal(t, FailureDial, ps[0].Failures[0].Reason)
+		assert.Equal(t, "connection refused", ps[0].Failures[0].Error)
+	})
+
+	t.Run("idle proxies are removed", func(t *testing.T) {
+		a := NewAdmin("secret")
+		a.failure("http://localhost:8081", Failure{ID: xid.New(), Time: time.Now().Add(-idleProxyTTL), Reason: FailureDial})
+		a.exitIP("http://localhost:8081", "203.0.113.1")
+		a.exitIPs["http://localhost:8081"] = exitIP{ip: "203.0.113.1", last: time.Now().Add(-idleProxyTTL)}
+		a.nextSweep = time.Time{}
+
+		a.failure("http://localhost:8082", Failure{ID: xid.New(), Time: time.Now(), Reason: FailureDial})
+		ps := a.Proxies()
+		assert.Len(t, ps, 1)
+		assert.Equal(t, "http://localhost:8082", ps[0].Proxy)
+	})
+
+	t.Run("facts", func(t *testing.T) {
+		f := writeConfig(t, "listen(':8080').\n:- dynamic(proxy/1).\n")
+		r, err := NewReloader(context.Background(), []string{f})
+		assert.NoError(t, err)
+
+		a := NewAdmin("secret")
+		assert.Equal(t, http.StatusNotFound, request(a, http.MethodGet, "/facts", "secret").Code)
+
+		a.Facts = r
+		assert.Equal(t, http.StatusNoContent, request(a, http.MethodPost, "/facts/assert", "secret", "proxy('http://localhost:8081').").Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, request(a, http.MethodPost, "/facts/assert", "secret", "listen(':8081'").Code)
+		assert.Equal(t, http.StatusNotFound, request(a, http.MethodPost, "/facts/retract", "secret", "proxy(foo).").Code)
+
+		w := request(a, http.MethodGet, "/facts", "secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), ":- dynamic(proxy/1).\nproxy('http://localhost:8081').\n")
+
+		assert.Equal(t, http.StatusNoContent, request(a, http.MethodPost, "/facts/retract", "secret", "proxy(_).").Code)
+		assert.NotContains(t, request(a, http.MethodGet, "/facts", "secret").Body.String(), "localhost:8081")
+	})
+}
@@ -0,0 +1,141 @@
+package proxima
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ichiban/prolog"
+	"github.com/ichiban/prolog/engine"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	proxyAuthenticate = "Proxy-Authenticate"
+	realm             = `Basic realm="proxima"`
+)
+
+// Authenticator checks the credentials of a client.
+type Authenticator func(ctx context.Context, user, password string) (bool, error)
+
+// authRequired reports whether clients have to be authenticated, which is the case if either Authenticate is set
+// or authenticate/2 is defined.
+func (s *Switcher) authRequired() bool {
+	return s.Authenticate != nil || s.hasAuthenticate
+}
+
+// authenticate checks the credentials with Authenticate if set. Otherwise, it queries authenticate/2.
+// If neither is available, everyone is authenticated.
+func (s *Switcher) authenticate(ctx context.Context, user, password string) (bool, error) {
+	if s.Authenticate != nil {
+		return s.Authenticate(ctx, user, password)
+	}
+
+	if !s.hasAuthenticate {
+		return true, nil
+	}
+
+	sol := s.QuerySolutionContext(ctx, `authenticate(?, ?).`, engine.Atom(user), engine.Atom(password))
+	switch err := sol.Err(); {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, prolog.ErrNoSolutions):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// proxyCredentials returns the username and password in Basic Proxy-Authorization header if any.
+func proxyCredentials(h http.Header) (string, string, error) {
+	auth := h.Get(proxyAuthorization)
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", err
+	}
+
+	user, password := string(b), ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		user, password = user[:i], user[i+1:]
+	}
+	return user, password, nil
+}
+
+// proxyAuthRequired replies with 407 Proxy Authentication Required and a challenge for Basic authentication.
+func proxyAuthRequired(w http.ResponseWriter) {
+	w.Header().Set(proxyAuthenticate, realm)
+	http.Error(w, "", http.StatusProxyAuthRequired)
+}
+
+// verified holds the digests of bcrypt hashes and passwords which are known to match so that we don't have to
+// compute bcrypt for every request.
+var verified sync.Map
+
+// Htpasswd succeeds if the htpasswd file has an entry for user with a bcrypt hash of password.
+func Htpasswd(file, user, password engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+	var args [3]string
+	for i, t := range []engine.Term{file, user, password} {
+		switch t := env.Resolve(t).(type) {
+		case engine.Variable:
+			return engine.Error(engine.ErrInstantiation)
+		case engine.Atom:
+			args[i] = string(t)
+		default:
+			return engine.Error(engine.TypeErrorAtom(t))
+		}
+	}
+
+	hash, err := htpasswdHash(args[0], args[1])
+	if err != nil {
+		return engine.Error(engine.SystemError(err))
+	}
+	if hash == "" {
+		return engine.Bool(false)
+	}
+
+	key := sha256.Sum256([]byte(hash + "\x00" + args[2]))
+	if _, ok := verified.Load(key); ok {
+		return k(env)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(args[2])); err != nil {
+		return engine.Bool(false)
+	}
+	verified.Store(key, struct{}{})
+	return k(env)
+}
+
+// htpasswdHash returns the hash for user in the htpasswd file, or an empty string if there's no entry for user.
+func htpasswdHash(file, user string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 || line[:i] != user {
+			continue
+		}
+		return line[i+1:], nil
+	}
+	return "", s.Err()
+}
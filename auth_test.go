@@ -0,0 +1,145 @@
+package proxima
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	f := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(f, []byte(fmt.Sprintf("# comment\nalice:%s\nbob:{SHA}xxx\n", hash)), 0600))
+
+	t.Run("ok", func(t *testing.T) {
+		ok, err := Htpasswd(engine.Atom(f), engine.Atom("alice"), engine.Atom("secret"), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		// Again from the cache.
+		ok, err = Htpasswd(engine.Atom(f), engine.Atom("alice"), engine.Atom("secret"), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		ok, err := Htpasswd(engine.Atom(f), engine.Atom("alice"), engine.Atom("wrong"), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		ok, err := Htpasswd(engine.Atom(f), engine.Atom("carol"), engine.Atom("secret"), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("not bcrypt", func(t *testing.T) {
+		ok, err := Htpasswd(engine.Atom(f), engine.Atom("bob"), engine.Atom("secret"), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("user is a variable", func(t *testing.T) {
+		_, err := Htpasswd(engine.Atom(f), engine.Variable("User"), engine.Atom("secret"), engine.Success, nil).Force(context.Background())
+		assert.Equal(t, engine.ErrInstantiation, err)
+	})
+
+	t.Run("file doesn't exist", func(t *testing.T) {
+		_, err := Htpasswd(engine.Atom(filepath.Join(t.TempDir(), "htpasswd")), engine.Atom("alice"), engine.Atom("secret"), engine.Success, nil).Force(context.Background())
+		assert.Error(t, err)
+	})
+}
+
+func TestSwitcher_Authenticate(t *testing.T) {
+	connect := func(s *Switcher, user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		r.RequestURI = "example.com:443"
+		if user != "" {
+			r.SetBasicAuth(user, password)
+			r.Header.Set(proxyAuthorization, r.Header.Get("Authorization"))
+			r.Header.Del("Authorization")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("not required", func(t *testing.T) {
+		s, err := New(nil)
+		assert.NoError(t, err)
+		assert.False(t, s.authRequired())
+
+		w := connect(s, "", "")
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("facts", func(t *testing.T) {
+		s := newTestSwitcher(t, `authenticate(alice, secret).`)
+		assert.True(t, s.authRequired())
+
+		w := connect(s, "alice", "secret")
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+
+		w = connect(s, "alice", "wrong")
+		assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+		assert.Equal(t, `Basic realm="proxima"`, w.Header().Get(proxyAuthenticate))
+
+		w = connect(s, "", "")
+		assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		s, err := New(nil)
+		assert.NoError(t, err)
+		s.Authenticate = func(_ context.Context, user, password string) (bool, error) {
+			return user == "bob" && password == "pass", nil
+		}
+		assert.True(t, s.authRequired())
+
+		w := connect(s, "bob", "pass")
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+
+		w = connect(s, "bob", "wrong")
+		assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+	})
+
+	t.Run("callback failed", func(t *testing.T) {
+		s, err := New(nil)
+		assert.NoError(t, err)
+		s.Authenticate = func(context.Context, string, string) (bool, error) {
+			return false, fmt.Errorf("unavailable")
+		}
+
+		w := connect(s, "bob", "pass")
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+}
+
+func TestProxyCredentials(t *testing.T) {
+	h := http.Header{}
+	h.Set(proxyAuthorization, "Basic dXNlcjpwYTpzcw==")
+	user, password, err := proxyCredentials(h)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "pa:ss", password)
+
+	user, password, err = proxyCredentials(http.Header{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", user)
+	assert.Equal(t, "", password)
+
+	h.Set(proxyAuthorization, "Basic !")
+	_, _, err = proxyCredentials(h)
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package proxima
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultNegativeCache is the maximum TTL of negative results of probes unless negative_cache(Seconds) is given.
+const defaultNegativeCache = time.Second
+
+// sweepInterval is how often expired results are removed from probeCache.
+const sweepInterval = time.Minute
+
+// probeCache memoizes the results of probes and deduplicates concurrent probes of the same key.
+type probeCache struct {
+	mu        sync.Mutex
+	entries   map[string]*probeEntry
+	nextSweep time.Time
+}
+
+type probeEntry struct {
+	done    chan struct{}
+	result  *probeResult
+	err     error
+	expires time.Time
+}
+
+func newProbeCache() *probeCache {
+	return &probeCache{
+		entries: map[string]*probeEntry{},
+	}
+}
+
+// do returns the result for key cached or being made by another call. Otherwise, it calls f and caches the result for
+// ttl if it's a 2XX status code, or for negativeTTL if not.
+func (c *probeCache) do(key string, ttl, negativeTTL time.Duration, f func() (*probeResult, error)) (*probeResult, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		select {
+		case <-e.done:
+			if now.Before(e.expires) {
+				c.mu.Unlock()
+				return e.result, e.err
+			}
+		default:
+			c.mu.Unlock()
+			<-e.done
+			return e.result, e.err
+		}
+	}
+	e := probeEntry{done: make(chan struct{})}
+	c.entries[key] = &e
+	c.sweep(now)
+	c.mu.Unlock()
+
+	e.result, e.err = f()
+	if e.err != nil || e.result.status/100 != 2 {
+		ttl = negativeTTL
+	}
+	e.expires = time.Now().Add(ttl)
+	close(e.done)
+
+	return e.result, e.err
+}
+
+// sweep removes expired results once in a while. It must be called with c.mu held.
+func (c *probeCache) sweep(now time.Time) {
+	if now.Before(c.nextSweep) {
+		return
+	}
+	c.nextSweep = now.Add(sweepInterval)
+
+	for k, e := range c.entries {
+		select {
+		case <-e.done:
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		default:
+		}
+	}
+}
+
+// probeKey identifies a probe by the proxy, the request, and the options which may change the result.
+func probeKey(proxy string, req *http.Request, conf probeConfig) string {
+	keys := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(proxy)
+	b.WriteString("\x00")
+	b.WriteString(req.Method)
+	b.WriteString("\x00")
+	b.WriteString(req.URL.String())
+	b.WriteString("\x00")
+	b.WriteString(conf.body)
+	var expect string
+	if conf.expectBody != nil {
+		expect = conf.expectBody.String()
+	}
+	_, _ = fmt.Fprintf(&b, "\x00%s\x00%d\x00%d\x00%t\x00%t", expect, conf.maxBody, conf.timeout, conf.insecure, conf.followRedirects)
+	for _, k := range keys {
+		b.WriteString("\x00")
+		b.WriteString(k)
+		for _, v := range req.Header[k] {
+			b.WriteString("\x00")
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
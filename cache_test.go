@@ -0,0 +1,143 @@
+package proxima
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeCache_Do(t *testing.T) {
+	t.Run("ttl", func(t *testing.T) {
+		c := newProbeCache()
+		var calls int32
+		f := func() (*probeResult, error) {
+			atomic.AddInt32(&calls, 1)
+			return &probeResult{status: http.StatusOK}, nil
+		}
+
+		for i := 0; i < 3; i++ {
+			r, err := c.do("key", 50*time.Millisecond, 0, f)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, r.status)
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+		time.Sleep(60 * time.Millisecond)
+		_, _ = c.do("key", 50*time.Millisecond, 0, f)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+		_, _ = c.do("another key", 50*time.Millisecond, 0, f)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("negative ttl", func(t *testing.T) {
+		c := newProbeCache()
+		var calls int32
+		f := func() (*probeResult, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, errors.New("connection refused")
+		}
+
+		_, err := c.do("key", time.Hour, 50*time.Millisecond, f)
+		assert.Error(t, err)
+		_, err = c.do("key", time.Hour, 50*time.Millisecond, f)
+		assert.Error(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+		time.Sleep(60 * time.Millisecond)
+		_, _ = c.do("key", time.Hour, 50*time.Millisecond, f)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("non-2XX status is negative", func(t *testing.T) {
+		c := newProbeCache()
+		var calls int32
+		f := func() (*probeResult, error) {
+			atomic.AddInt32(&calls, 1)
+			return &probeResult{status: http.StatusServiceUnavailable}, nil
+		}
+
+		r, err := c.do("key", time.Hour, 0, f)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, r.status)
+		_, _ = c.do("key", time.Hour, 0, f)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("single flight", func(t *testing.T) {
+		c := newProbeCache()
+		var calls int32
+		release := make(chan struct{})
+		f := func() (*probeResult, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return &probeResult{status: http.StatusOK}, nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r, err := c.do("key", time.Hour, 0, f)
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusOK, r.status)
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+}
+
+func TestProbeKey(t *testing.T) {
+	req := func(header http.Header) *http.Request {
+		r, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		assert.NoError(t, err)
+		r.Header = header
+		return r
+	}
+
+	assert.Equal(t,
+		probeKey("localhost:8080", req(http.Header{"A": {"1"}, "B": {"2"}}), probeConfig{}),
+		probeKey("localhost:8080", req(http.Header{"B": {"2"}, "A": {"1"}}), probeConfig{}))
+	assert.NotEqual(t,
+		probeKey("localhost:8080", req(http.Header{"A": {"1"}}), probeConfig{}),
+		probeKey("localhost:8080", req(http.Header{"A": {"2"}}), probeConfig{}))
+	assert.NotEqual(t,
+		probeKey("localhost:8080", req(nil), probeConfig{}),
+		probeKey("localhost:8081", req(nil), probeConfig{}))
+
+	post := req(nil)
+	post.Method = http.MethodPost
+	assert.NotEqual(t,
+		probeKey("localhost:8080", req(nil), probeConfig{}),
+		probeKey("localhost:8080", post, probeConfig{}))
+	assert.NotEqual(t,
+		probeKey("localhost:8080", post, probeConfig{body: "a"}),
+		probeKey("localhost:8080", post, probeConfig{body: "b"}))
+
+	for _, conf := range []probeConfig{
+		{expectBody: regexp.MustCompile("ok")},
+		{maxBody: 10},
+		{timeout: time.Second},
+		{insecure: true},
+		{followRedirects: true},
+	} {
+		assert.NotEqual(t,
+			probeKey("localhost:8080", req(nil), probeConfig{}),
+			probeKey("localhost:8080", req(nil), conf))
+	}
+
+	// The TTLs don't change the result.
+	assert.Equal(t,
+		probeKey("localhost:8080", req(nil), probeConfig{}),
+		probeKey("localhost:8080", req(nil), probeConfig{cache: time.Minute, negativeCache: time.Second}))
+}
@@ -0,0 +1,206 @@
+package proxima
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ichiban/prolog"
+	"github.com/ichiban/prolog/engine"
+)
+
+// Circuit states of proxies.
+const (
+	CircuitClosed   = "closed"    // the proxy is in use
+	CircuitOpen     = "open"      // the proxy is skipped until the cooldown ends
+	CircuitHalfOpen = "half_open" // a single trial decides whether the proxy is closed or open again
+)
+
+// circuitConfig is the thresholds declared by circuit_breaker(Failures, CooldownSeconds).
+// The circuit breaker is disabled if failures is zero.
+type circuitConfig struct {
+	failures int
+	cooldown time.Duration
+}
+
+// circuitBreaker keeps track of consecutive failures of proxies and skips the proxies failing too often.
+type circuitBreaker struct {
+	mu     sync.Mutex
+	states map[string]*circuitState
+}
+
+type circuitState struct {
+	state    string
+	failures int
+	opened   time.Time
+	trial    bool
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		states: map[string]*circuitState{},
+	}
+}
+
+// allow reports whether the proxy can be attempted. Once the cooldown of an open circuit ends, it allows a single
+// trial and the circuit becomes half-open.
+func (b *circuitBreaker) allow(conf circuitConfig, proxy string) bool {
+	if b == nil || conf.failures == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.states[proxy]
+	if !ok {
+		return true
+	}
+	switch st.state {
+	case CircuitOpen:
+		if time.Since(st.opened) < conf.cooldown {
+			return false
+		}
+		st.state = CircuitHalfOpen
+		st.trial = true
+		return true
+	case CircuitHalfOpen:
+		if st.trial {
+			return false
+		}
+		st.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// failure records a failed attempt via the proxy and opens the circuit if it's half-open or the proxy has failed too
+// many times in a row.
+func (b *circuitBreaker) failure(conf circuitConfig, proxy string) {
+	if b == nil || conf.failures == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.states[proxy]
+	if !ok {
+		st = &circuitState{state: CircuitClosed}
+		b.states[proxy] = st
+	}
+	st.failures++
+	st.trial = false
+	if st.state == CircuitOpen || (st.state == CircuitClosed && st.failures < conf.failures) {
+		return
+	}
+	st.state = CircuitOpen
+	st.opened = time.Now()
+}
+
+// success records a successful attempt via the proxy and closes the circuit.
+func (b *circuitBreaker) success(proxy string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.states, proxy)
+}
+
+// release ends the trial of a half-open circuit which ended without success or failure, e.g. the request was
+// canceled, so that another trial can be made.
+func (b *circuitBreaker) release(proxy string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if st, ok := b.states[proxy]; ok {
+		st.trial = false
+	}
+}
+
+// state returns the circuit state of the proxy.
+func (b *circuitBreaker) state(proxy string) string {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.states[proxy]
+	if !ok {
+		return CircuitClosed
+	}
+	return st.state
+}
+
+// failing returns the proxies which have failed since their last success and their circuit states sorted by proxy.
+func (b *circuitBreaker) failing() [][2]string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ss := make([][2]string, 0, len(b.states))
+	for p, st := range b.states {
+		ss = append(ss, [2]string{p, st.state})
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i][0] < ss[j][0]
+	})
+	return ss
+}
+
+// circuit unifies the proxy and its circuit state. The proxy is any solution of tunnel/2. If the proxy is a variable, it
+// enumerates the proxies which have failed since their last success.
+func (b *circuitBreaker) circuit(proxy, state engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+	switch p := env.Resolve(proxy).(type) {
+	case engine.Variable:
+		ss := b.failing()
+		ks := make([]func(context.Context) *engine.Promise, len(ss))
+		for i := range ss {
+			s := ss[i]
+			ks[i] = func(context.Context) *engine.Promise {
+				given := engine.Compound{Args: []engine.Term{proxy, state}}
+				actual := engine.Compound{Args: []engine.Term{engine.Atom(s[0]), engine.Atom(s[1])}}
+				return engine.Unify(&given, &actual, k, env)
+			}
+		}
+		return engine.Delay(ks...)
+	default:
+		name, err := proxyName(p, env)
+		if err != nil {
+			return engine.Error(err)
+		}
+		return engine.Unify(state, engine.Atom(b.state(name)), k, env)
+	}
+}
+
+// circuitConfig returns the thresholds declared by circuit_breaker/2.
+func (s *Switcher) circuitConfig() (circuitConfig, error) {
+	var sol struct {
+		Failures engine.Term
+		Cooldown engine.Term
+	}
+	switch err := s.QuerySolution(`circuit_breaker(Failures, Cooldown).`).Scan(&sol); {
+	case err == nil:
+		break
+	case errors.Is(err, prolog.ErrNoSolutions):
+		return circuitConfig{}, nil
+	default:
+		return circuitConfig{}, err
+	}
+
+	n, ok := sol.Failures.(engine.Integer)
+	if !ok || n <= 0 {
+		return circuitConfig{}, engine.DomainError("positive_integer", sol.Failures)
+	}
+	d, err := seconds(sol.Cooldown)
+	if err != nil {
+		return circuitConfig{}, err
+	}
+	return circuitConfig{failures: int(n), cooldown: d}, nil
+}
@@ -0,0 +1,138 @@
+package proxima
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const proxy = "http://localhost:8081"
+	conf := circuitConfig{failures: 2, cooldown: 50 * time.Millisecond}
+
+	t.Run("open after consecutive failures", func(t *testing.T) {
+		b := newCircuitBreaker()
+		assert.True(t, b.allow(conf, proxy))
+		b.failure(conf, proxy)
+		assert.Equal(t, CircuitClosed, b.state(proxy))
+		assert.True(t, b.allow(conf, proxy))
+		b.failure(conf, proxy)
+		assert.Equal(t, CircuitOpen, b.state(proxy))
+		assert.False(t, b.allow(conf, proxy))
+	})
+
+	t.Run("success resets failures", func(t *testing.T) {
+		b := newCircuitBreaker()
+		b.failure(conf, proxy)
+		b.success(proxy)
+		b.failure(conf, proxy)
+		assert.Equal(t, CircuitClosed, b.state(proxy))
+	})
+
+	t.Run("half-open", func(t *testing.T) {
+		b := newCircuitBreaker()
+		b.failure(conf, proxy)
+		b.failure(conf, proxy)
+		time.Sleep(60 * time.Millisecond)
+
+		// A single trial at a time.
+		assert.True(t, b.allow(conf, proxy))
+		assert.Equal(t, CircuitHalfOpen, b.state(proxy))
+		assert.False(t, b.allow(conf, proxy))
+
+		// A trial without an outcome lets another trial go.
+		b.release(proxy)
+		assert.True(t, b.allow(conf, proxy))
+
+		// A failed trial opens it again.
+		b.failure(conf, proxy)
+		assert.Equal(t, CircuitOpen, b.state(proxy))
+		assert.False(t, b.allow(conf, proxy))
+		time.Sleep(60 * time.Millisecond)
+
+		// A successful trial closes it.
+		assert.True(t, b.allow(conf, proxy))
+		b.success(proxy)
+		assert.Equal(t, CircuitClosed, b.state(proxy))
+		assert.True(t, b.allow(conf, proxy))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		b := newCircuitBreaker()
+		for i := 0; i < 10; i++ {
+			b.failure(circuitConfig{}, proxy)
+		}
+		assert.True(t, b.allow(circuitConfig{}, proxy))
+		assert.Equal(t, CircuitClosed, b.state(proxy))
+	})
+
+	t.Run("enumerate", func(t *testing.T) {
+		b := newCircuitBreaker()
+		b.failure(conf, "http://localhost:8082")
+		b.failure(conf, proxy)
+		b.failure(conf, proxy)
+
+		var got [][2]engine.Term
+		state := engine.NewVariable()
+		p := engine.NewVariable()
+		ok, err := b.circuit(p, state, func(env *engine.Env) *engine.Promise {
+			got = append(got, [2]engine.Term{env.Resolve(p), env.Resolve(state)})
+			return engine.Bool(false)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, [][2]engine.Term{
+			{engine.Atom(proxy), engine.Atom(CircuitOpen)},
+			{engine.Atom("http://localhost:8082"), engine.Atom(CircuitClosed)},
+		}, got)
+	})
+
+	t.Run("compound proxies", func(t *testing.T) {
+		b := newCircuitBreaker()
+		b.failure(conf, "chain([localhost:3128,localhost:3129])")
+		b.failure(conf, "chain([localhost:3128,localhost:3129])")
+
+		for _, tc := range []struct {
+			proxy engine.Term
+			state engine.Atom
+		}{
+			{proxy: engine.Atom("chain").Apply(engine.List(engine.Atom("localhost:3128"), engine.Atom("localhost:3129"))), state: CircuitOpen},
+			{proxy: engine.Atom("direct").Apply(engine.Atom("10.0.0.1")), state: CircuitClosed},
+		} {
+			state := engine.NewVariable()
+			ok, err := b.circuit(tc.proxy, state, func(env *engine.Env) *engine.Promise {
+				assert.Equal(t, tc.state, env.Resolve(state))
+				return engine.Bool(true)
+			}, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+	})
+}
+
+func TestSwitcher_CircuitConfig(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		s, err := New([]string{writeConfig(t, "circuit_breaker(3, 0.5).")})
+		assert.NoError(t, err)
+		assert.Equal(t, circuitConfig{failures: 3, cooldown: 500 * time.Millisecond}, s.circuit)
+	})
+
+	t.Run("not declared", func(t *testing.T) {
+		s, err := New([]string{writeConfig(t, "")})
+		assert.NoError(t, err)
+		assert.Equal(t, circuitConfig{}, s.circuit)
+	})
+
+	t.Run("failures is not a positive integer", func(t *testing.T) {
+		_, err := New([]string{writeConfig(t, "circuit_breaker(0, 30).")})
+		assert.Equal(t, engine.DomainError("positive_integer", engine.Integer(0)), err)
+	})
+
+	t.Run("cooldown is not a number", func(t *testing.T) {
+		_, err := New([]string{writeConfig(t, "circuit_breaker(3, foo).")})
+		assert.Equal(t, engine.TypeError("number", engine.Atom("foo")), err)
+	})
+}
@@ -8,16 +8,34 @@ import (
 	"github.com/rs/zerolog/hlog"
 	"golang.org/x/term"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"proxima"
+	"reflect"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/justinas/alice"
 )
 
 func main() {
+	var (
+		watch, idle        time.Duration
+		connect, handshake time.Duration
+		metrics            string
+		admin              string
+		facts              string
+	)
+	flag.DurationVar(&watch, "watch", 0, "interval to check the configuration files for changes (0 to disable)")
+	flag.DurationVar(&idle, "idle", 0, "time to close tunnels without traffic in either direction (0 to disable)")
+	flag.DurationVar(&connect, "connect", 10*time.Second, "time to give up connecting to proxies (0 to disable)")
+	flag.DurationVar(&handshake, "handshake", 10*time.Second, "time to give up waiting for proxies to respond to CONNECT or SOCKS handshakes (0 to disable)")
+	flag.StringVar(&metrics, "metrics", "", "address to expose metrics in Prometheus text format (overrides metrics_listen/1)")
+	flag.StringVar(&admin, "admin", "", "address to serve the admin API protected by the token in $PROXIMA_ADMIN_TOKEN (empty to disable)")
+	flag.StringVar(&facts, "facts", "", "file to persist clauses asserted and retracted via the admin API (empty to keep them in memory)")
 	flag.Parse()
 
 	w := io.Writer(os.Stderr)
@@ -29,32 +47,138 @@ func main() {
 		Timestamp().
 		Logger()
 
-	s, err := proxima.New(flag.Args())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, proxima.LogKey, &log)
+
+	r, err := proxima.NewReloader(ctx, flag.Args())
 	if err != nil {
-		log.Fatal().Err(err).Msg("proxima.Open() failed")
+		log.Fatal().Err(err).Msg("proxima.NewReloader() failed")
+	}
+	r.Switcher().IdleTimeout = idle
+	r.Switcher().ConnectTimeout = connect
+	r.Switcher().HandshakeTimeout = handshake
+	r.Switcher().Metrics = proxima.NewMetrics()
+	r.Switcher().Health = proxima.NewHealthChecker()
+	if facts != "" {
+		if err := r.Persist(ctx, facts); err != nil {
+			log.Fatal().Err(err).Msg("r.Persist() failed")
+		}
+	}
+	if admin != "" {
+		token := os.Getenv("PROXIMA_ADMIN_TOKEN")
+		if token == "" {
+			log.Fatal().Msg("PROXIMA_ADMIN_TOKEN is required for -admin")
+		}
+		a := proxima.NewAdmin(token)
+		a.Facts = r
+		r.Switcher().Admin = a
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
+	go reload(ctx, r, log, watch)
+	go r.Switcher().Health.Run(ctx, r)
 
-	serve(ctx, s, log)
+	serve(ctx, r, log, metrics, admin)
 }
 
-func serve(ctx context.Context, s *proxima.Switcher, log zerolog.Logger) {
-	ctx = context.WithValue(ctx, proxima.LogKey, &log)
+func reload(ctx context.Context, r *proxima.Reloader, log zerolog.Logger, watch time.Duration) {
+	listeners, err := r.Switcher().Listeners(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("r.Switcher().Listeners() failed")
+	}
+
+	report := func(trigger string, err error) {
+		if err != nil {
+			log.Err(err).Str("trigger", trigger).Msg("reload failed")
+			return
+		}
+		log.Info().Str("trigger", trigger).Msg("reload")
 
-	var result struct {
-		Addr string
+		ls, err := r.Switcher().Listeners(ctx)
+		if err != nil {
+			log.Err(err).Msg("r.Switcher().Listeners() failed")
+			return
+		}
+		if !reflect.DeepEqual(ls, listeners) {
+			log.Warn().Msg("changes in listen/2 take effect after restart")
+		}
 	}
-	if err := s.QuerySolutionContext(ctx, `listen(Addr).`).Scan(&result); err != nil {
-		log.Fatal().Err(err).Msg("listen(Addr) failed")
+
+	if watch > 0 {
+		go r.Watch(ctx, watch, func(err error) {
+			report("watch", err)
+		})
 	}
 
-	log.Info().Str("addr", result.Addr).Msg("start")
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			report("SIGHUP", r.Reload(ctx))
+		}
+	}
+}
+
+func serve(ctx context.Context, r *proxima.Reloader, log zerolog.Logger, metrics, admin string) {
+	listeners, err := r.Switcher().Listeners(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("r.Switcher().Listeners() failed")
+	}
+
+	if metrics == "" {
+		metrics, err = r.Switcher().MetricsListener(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("r.Switcher().MetricsListener() failed")
+		}
+	}
+
+	var wg sync.WaitGroup
+	if metrics != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", r.Switcher().Metrics)
+			serveHTTP(ctx, log.With().Str("protocol", "metrics").Logger(), metrics, mux)
+		}()
+	}
+	if admin != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveHTTP(ctx, log.With().Str("protocol", "admin").Logger(), admin, r.Switcher().Admin)
+		}()
+	}
+	for _, l := range listeners {
+		l := l
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch l.Protocol {
+			case "http":
+				log := log.With().Str("protocol", "http").Logger()
+				serveHTTP(ctx, log, l.Addr, handler(r, log))
+			case "socks5":
+				serveSOCKS5(ctx, r, log, l.Addr)
+			default:
+				log.Fatal().Str("protocol", l.Protocol).Msg("unknown protocol")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func serveHTTP(ctx context.Context, log zerolog.Logger, addr string, h http.Handler) {
+	log.Info().Str("addr", addr).Msg("start")
 
 	srv := http.Server{
-		Addr:    result.Addr,
-		Handler: handler(s, log),
+		Addr:    addr,
+		Handler: h,
 	}
 	go func() {
 		<-ctx.Done()
@@ -66,17 +190,41 @@ func serve(ctx context.Context, s *proxima.Switcher, log zerolog.Logger) {
 	}()
 	switch err := srv.ListenAndServe(); {
 	case errors.Is(err, http.ErrServerClosed):
-		log.Info().Str("addr", result.Addr).Msg("finish")
+		log.Info().Str("addr", addr).Msg("finish")
 	default:
 		log.Fatal().Err(err).Msg("srv.ListenAndServe() failed")
 	}
 }
 
-func handler(s *proxima.Switcher, log zerolog.Logger) http.Handler {
+func serveSOCKS5(ctx context.Context, r *proxima.Reloader, log zerolog.Logger, addr string) {
+	log = log.With().Str("protocol", "socks5").Logger()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("net.Listen() failed")
+	}
+
+	log.Info().Str("addr", addr).Msg("start")
+
+	go func() {
+		<-ctx.Done()
+		if err := l.Close(); err != nil {
+			log.Fatal().Err(err).Msg("l.Close() failed")
+		}
+	}()
+	switch err := r.ServeSOCKS5(context.WithValue(ctx, proxima.LogKey, &log), l); {
+	case errors.Is(err, net.ErrClosed):
+		log.Info().Str("addr", addr).Msg("finish")
+	default:
+		log.Fatal().Err(err).Msg("s.ServeSOCKS5() failed")
+	}
+}
+
+func handler(r *proxima.Reloader, log zerolog.Logger) http.Handler {
 	return alice.New(
 		hlog.NewHandler(log),
 		hlog.RemoteAddrHandler("remote"),
 		hlog.UserAgentHandler("ua"),
 		hlog.RequestIDHandler("rid", "Request-Id"),
-	).Then(s)
+	).Then(r)
 }
@@ -0,0 +1,214 @@
+package proxima
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ichiban/prolog"
+	"github.com/ichiban/prolog/engine"
+)
+
+// defaultQueueTimeout is how long a request waits in the queue of a proxy at capacity unless timeout(Ms) is given.
+const defaultQueueTimeout = 10 * time.Second
+
+// connectionLimit is the limit declared by max_connections(Proxy, Max, Options). The number of connections is
+// unlimited if max is zero.
+type connectionLimit struct {
+	max int
+	// queue is the number of requests which can wait for a connection to be released.
+	queue int
+	// timeout is how long a request waits in the queue.
+	timeout time.Duration
+}
+
+// connections keeps track of live connections via each proxy and admits new ones within the limits.
+type connections struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	waiting  map[string]int
+	released map[string]chan struct{}
+}
+
+func newConnections() *connections {
+	return &connections{
+		counts:   map[string]int{},
+		waiting:  map[string]int{},
+		released: map[string]chan struct{}{},
+	}
+}
+
+// acquire counts a new connection via the proxy if it's within the limit. If the proxy is at capacity, it waits in
+// the queue until a connection is released, the timeout, or ctx is done. It reports whether the connection is counted.
+func (c *connections) acquire(ctx context.Context, proxy string, l connectionLimit) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	for {
+		if l.max == 0 || c.counts[proxy] < l.max {
+			c.counts[proxy]++
+			return true
+		}
+
+		if timeout == nil {
+			if c.waiting[proxy] >= l.queue {
+				return false
+			}
+			t := time.NewTimer(l.timeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		ch, ok := c.released[proxy]
+		if !ok {
+			ch = make(chan struct{})
+			c.released[proxy] = ch
+		}
+
+		c.waiting[proxy]++
+		c.mu.Unlock()
+		var done bool
+		select {
+		case <-ch:
+		case <-timeout:
+			done = true
+		case <-ctx.Done():
+			done = true
+		}
+		c.mu.Lock()
+		if c.waiting[proxy]--; c.waiting[proxy] == 0 {
+			delete(c.waiting, proxy)
+		}
+		if done {
+			return false
+		}
+	}
+}
+
+// release uncounts a connection via the proxy and wakes up the requests waiting for it.
+func (c *connections) release(proxy string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[proxy]--; c.counts[proxy] <= 0 {
+		delete(c.counts, proxy)
+	}
+	if ch, ok := c.released[proxy]; ok {
+		close(ch)
+		delete(c.released, proxy)
+	}
+}
+
+// count returns the number of live connections via the proxy.
+func (c *connections) count(proxy string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[proxy]
+}
+
+// proxyCount is the number of live connections via a proxy.
+type proxyCount struct {
+	proxy string
+	n     int
+}
+
+// live returns the proxies with live connections and their numbers sorted by proxy.
+func (c *connections) live() []proxyCount {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ls := make([]proxyCount, 0, len(c.counts))
+	for p, n := range c.counts {
+		ls = append(ls, proxyCount{proxy: p, n: n})
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].proxy < ls[j].proxy
+	})
+	return ls
+}
+
+// connections unifies the proxy and the number of its live connections. The proxy is any solution of tunnel/2. If the
+// proxy is a variable, it enumerates the proxies with live connections.
+func (c *connections) connections(proxy, n engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+	switch p := env.Resolve(proxy).(type) {
+	case engine.Variable:
+		ls := c.live()
+		ks := make([]func(context.Context) *engine.Promise, len(ls))
+		for i := range ls {
+			l := ls[i]
+			ks[i] = func(context.Context) *engine.Promise {
+				given := engine.Compound{Args: []engine.Term{proxy, n}}
+				actual := engine.Compound{Args: []engine.Term{engine.Atom(l.proxy), engine.Integer(l.n)}}
+				return engine.Unify(&given, &actual, k, env)
+			}
+		}
+		return engine.Delay(ks...)
+	default:
+		name, err := proxyName(p, env)
+		if err != nil {
+			return engine.Error(err)
+		}
+		return engine.Unify(n, engine.Integer(c.count(name)), k, env)
+	}
+}
+
+// connectionLimit returns the limit declared by max_connections/3 for the proxy, the solution of tunnel/2.
+func (s *Switcher) connectionLimit(ctx context.Context, proxy engine.Term) (connectionLimit, error) {
+	var sol struct {
+		Max     engine.Term
+		Options engine.Term
+	}
+	switch err := s.QuerySolutionContext(ctx, `max_connections(?, Max, Options).`, proxy).Scan(&sol); {
+	case err == nil:
+		break
+	case errors.Is(err, prolog.ErrNoSolutions):
+		return connectionLimit{}, nil
+	default:
+		return connectionLimit{}, err
+	}
+
+	n, ok := sol.Max.(engine.Integer)
+	if !ok {
+		return connectionLimit{}, engine.TypeErrorInteger(sol.Max)
+	}
+	if n <= 0 {
+		return connectionLimit{}, engine.DomainError("positive_integer", sol.Max)
+	}
+	l := connectionLimit{max: int(n), timeout: defaultQueueTimeout}
+
+	iter := engine.ListIterator{List: sol.Options}
+	for iter.Next() {
+		o, ok := iter.Current().(*engine.Compound)
+		if !ok || len(o.Args) != 1 {
+			continue
+		}
+		v, ok := o.Args[0].(engine.Integer)
+		if !ok {
+			return connectionLimit{}, engine.TypeErrorInteger(o.Args[0])
+		}
+		if v < 0 {
+			return connectionLimit{}, engine.DomainError("not_less_than_zero", o.Args[0])
+		}
+		switch o.Functor {
+		case "queue":
+			l.queue = int(v)
+		case "timeout":
+			l.timeout = time.Duration(v) * time.Millisecond
+		}
+	}
+	return l, iter.Err()
+}
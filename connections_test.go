@@ -0,0 +1,183 @@
+package proxima
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnections(t *testing.T) {
+	const proxy = "http://localhost:8081"
+
+	t.Run("at capacity", func(t *testing.T) {
+		c := newConnections()
+		l := connectionLimit{max: 2}
+		assert.True(t, c.acquire(context.Background(), proxy, l))
+		assert.True(t, c.acquire(context.Background(), proxy, l))
+		assert.False(t, c.acquire(context.Background(), proxy, l))
+		assert.Equal(t, 2, c.count(proxy))
+
+		c.release(proxy)
+		assert.Equal(t, 1, c.count(proxy))
+		assert.True(t, c.acquire(context.Background(), proxy, l))
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		c := newConnections()
+		for i := 0; i < 10; i++ {
+			assert.True(t, c.acquire(context.Background(), proxy, connectionLimit{}))
+		}
+		assert.Equal(t, 10, c.count(proxy))
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		c := newConnections()
+		l := connectionLimit{max: 1, queue: 1, timeout: 5 * time.Second}
+		assert.True(t, c.acquire(context.Background(), proxy, l))
+
+		acquired := make(chan bool)
+		go func() {
+			acquired <- c.acquire(context.Background(), proxy, l)
+		}()
+		assert.Eventually(t, func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.waiting[proxy] == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// The queue is full.
+		assert.False(t, c.acquire(context.Background(), proxy, l))
+
+		c.release(proxy)
+		assert.True(t, <-acquired)
+		assert.Equal(t, 1, c.count(proxy))
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		c := newConnections()
+		l := connectionLimit{max: 1, queue: 1, timeout: 50 * time.Millisecond}
+		assert.True(t, c.acquire(context.Background(), proxy, l))
+		assert.False(t, c.acquire(context.Background(), proxy, l))
+		assert.Equal(t, 1, c.count(proxy))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		c := newConnections()
+		l := connectionLimit{max: 1, queue: 1, timeout: 5 * time.Second}
+		assert.True(t, c.acquire(context.Background(), proxy, l))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.False(t, c.acquire(ctx, proxy, l))
+	})
+
+	t.Run("enumerate", func(t *testing.T) {
+		c := newConnections()
+		assert.True(t, c.acquire(context.Background(), "http://localhost:8082", connectionLimit{}))
+		assert.True(t, c.acquire(context.Background(), proxy, connectionLimit{}))
+		assert.True(t, c.acquire(context.Background(), proxy, connectionLimit{}))
+
+		var got [][2]engine.Term
+		n := engine.NewVariable()
+		p := engine.NewVariable()
+		ok, err := c.connections(p, n, func(env *engine.Env) *engine.Promise {
+			got = append(got, [2]engine.Term{env.Resolve(p), env.Resolve(n)})
+			return engine.Bool(false)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, [][2]engine.Term{
+			{engine.Atom(proxy), engine.Integer(2)},
+			{engine.Atom("http://localhost:8082"), engine.Integer(1)},
+		}, got)
+	})
+
+	t.Run("compound proxies", func(t *testing.T) {
+		c := newConnections()
+		assert.True(t, c.acquire(context.Background(), "direct(10.0.0.1)", connectionLimit{}))
+		assert.True(t, c.acquire(context.Background(), "chain([localhost:3128,localhost:3129])", connectionLimit{}))
+		assert.True(t, c.acquire(context.Background(), "chain([localhost:3128,localhost:3129])", connectionLimit{}))
+
+		for _, tc := range []struct {
+			proxy engine.Term
+			n     engine.Integer
+		}{
+			{proxy: engine.Atom("direct").Apply(engine.Atom("10.0.0.1")), n: 1},
+			{proxy: engine.Atom("chain").Apply(engine.List(engine.Atom("localhost:3128"), engine.Atom("localhost:3129"))), n: 2},
+			{proxy: engine.Atom("direct"), n: 0},
+		} {
+			n := engine.NewVariable()
+			ok, err := c.connections(tc.proxy, n, func(env *engine.Env) *engine.Promise {
+				assert.Equal(t, tc.n, env.Resolve(n))
+				return engine.Bool(true)
+			}, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+	})
+
+	t.Run("not a proxy", func(t *testing.T) {
+		c := newConnections()
+		proxy := engine.Atom("foo").Apply(engine.Integer(1))
+		_, err := c.connections(proxy, engine.NewVariable(), func(env *engine.Env) *engine.Promise {
+			return engine.Bool(true)
+		}, nil).Force(context.Background())
+		assert.Equal(t, engine.DomainError("proxy", proxy), err)
+	})
+}
+
+func TestSwitcher_ConnectionLimit(t *testing.T) {
+	const proxy = "http://localhost:8081"
+
+	t.Run("max", func(t *testing.T) {
+		s := newTestSwitcher(t, "max_connections('http://localhost:8081', 5).")
+		l, err := s.connectionLimit(context.Background(), engine.Atom(proxy))
+		assert.NoError(t, err)
+		assert.Equal(t, connectionLimit{max: 5, timeout: defaultQueueTimeout}, l)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		s := newTestSwitcher(t, "max_connections(_, 5, [queue(10), timeout(2000)]).")
+		l, err := s.connectionLimit(context.Background(), engine.Atom(proxy))
+		assert.NoError(t, err)
+		assert.Equal(t, connectionLimit{max: 5, queue: 10, timeout: 2 * time.Second}, l)
+	})
+
+	t.Run("not declared", func(t *testing.T) {
+		s := newTestSwitcher(t, "max_connections('http://localhost:8082', 5).")
+		l, err := s.connectionLimit(context.Background(), engine.Atom(proxy))
+		assert.NoError(t, err)
+		assert.Equal(t, connectionLimit{}, l)
+	})
+
+	t.Run("compound proxies", func(t *testing.T) {
+		s := newTestSwitcher(t, `
+max_connections(direct('10.0.0.1'), 2).
+max_connections(chain(['localhost:3128', 'localhost:3129']), 3).
+`)
+		l, err := s.connectionLimit(context.Background(), engine.Atom("direct").Apply(engine.Atom("10.0.0.1")))
+		assert.NoError(t, err)
+		assert.Equal(t, connectionLimit{max: 2, timeout: defaultQueueTimeout}, l)
+
+		p, err := s.proxy(context.Background(), engine.Atom("chain").Apply(engine.List(engine.Atom("localhost:3128"), engine.Atom("localhost:3129"))))
+		assert.NoError(t, err)
+		l, err = s.connectionLimit(context.Background(), p.term)
+		assert.NoError(t, err)
+		assert.Equal(t, connectionLimit{max: 3, timeout: defaultQueueTimeout}, l)
+	})
+
+	t.Run("max is not a positive integer", func(t *testing.T) {
+		s := newTestSwitcher(t, "max_connections(_, 0).")
+		_, err := s.connectionLimit(context.Background(), engine.Atom(proxy))
+		assert.Equal(t, engine.DomainError("positive_integer", engine.Integer(0)), err)
+	})
+
+	t.Run("queue is negative", func(t *testing.T) {
+		s := newTestSwitcher(t, "max_connections(_, 5, [queue(-1)]).")
+		_, err := s.connectionLimit(context.Background(), engine.Atom(proxy))
+		assert.Equal(t, engine.DomainError("not_less_than_zero", engine.Integer(-1)), err)
+	})
+}
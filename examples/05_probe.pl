@@ -3,14 +3,15 @@
 listen(':8080').
 
 % Similar to 00_sequential.pl, but filters out proxies by their probing results.
+% The results are reused for 30 seconds, or for 5 seconds if failed, instead of probing on every request.
 tunnel(Proxy, _) :-
     Proxy = 'localhost:8081',
-    probe(Proxy, 'https://httpbin.org/status/404').
+    probe(Proxy, 'https://httpbin.org/status/404', [cache(30), negative_cache(5)]).
 
 tunnel(Proxy, _) :-
     Proxy = 'localhost:8082',
-    probe(Proxy, 'https://httpbin.org/status/404').
+    probe(Proxy, 'https://httpbin.org/status/404', [cache(30), negative_cache(5)]).
 
 tunnel(Proxy, _) :-
     Proxy = 'localhost:8083',
-    probe(Proxy, 'https://httpbin.org/status/200').
+    probe(Proxy, 'https://httpbin.org/status/200', [cache(30), negative_cache(5)]).
@@ -0,0 +1,10 @@
+% The proxy manager will be available at localhost:8080 for HTTP and localhost:1080 for SOCKS5.
+%   curl -x localhost:8080 https://httpbin.org/ip
+%   curl -x socks5h://localhost:1080 https://httpbin.org/ip
+listen(':8080').
+listen(':1080', socks5).
+
+% Tags are passed in the username of SOCKS5 username/password authentication.
+%   curl -x socks5h://one:@localhost:1080 https://httpbin.org/ip
+tunnel('localhost:8081', Options) :- member(one, Options).
+tunnel('localhost:8082', _).
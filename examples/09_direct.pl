@@ -0,0 +1,14 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 http://intranet.example.com:8000/
+listen(':8080').
+
+% Internal hosts go direct.
+tunnel(direct, Options) :-
+    member(target(Target), Options),
+    host_port(Target, Host, _),
+    atom_concat(_, '.example.com', Host),
+    !.
+
+% Everything else goes through the proxies.
+tunnel('localhost:8081', _).
+tunnel('localhost:8082', _).
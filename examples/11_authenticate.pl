@@ -0,0 +1,11 @@
+% The proxy manager will be available at localhost:8080 for authenticated clients only.
+%   curl -x alice:secret@localhost:8080 https://example.com/
+listen(':8080').
+
+% Clients are authenticated either by facts or by an htpasswd file.
+%   htpasswd -B -c users.htpasswd bob
+authenticate(alice, secret).
+authenticate(User, Password) :-
+    htpasswd('users.htpasswd', User, Password).
+
+tunnel('localhost:8081', _).
@@ -0,0 +1,13 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 https://httpbin.org/ip
+listen(':8080').
+
+% The list of proxies can be changed at runtime via the admin API.
+%   PROXIMA_ADMIN_TOKEN=secret proxima -admin 127.0.0.1:9091 -facts facts.pl examples/12_dynamic_proxies.pl
+%   curl -H 'Authorization: Bearer secret' -d "proxy('localhost:8082')." http://127.0.0.1:9091/facts/assert
+%   curl -H 'Authorization: Bearer secret' -d "proxy('localhost:8081')." http://127.0.0.1:9091/facts/retract
+:- dynamic(proxy/1).
+proxy('localhost:8081').
+
+tunnel(Proxy, _) :-
+    proxy(Proxy).
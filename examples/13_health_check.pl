@@ -0,0 +1,12 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 https://httpbin.org/ip
+listen(':8080').
+
+% Similar to 05_probe.pl, but probes proxies every 10 seconds in the background instead of on each request.
+% A proxy becomes unhealthy after 3 failures in a row and healthy again after 2 successes in a row.
+health_check(Proxy, 'https://httpbin.org/status/200', 10, [rise(2), fall(3), timeout(5000)]) :-
+    member(Proxy, ['localhost:8081', 'localhost:8082', 'localhost:8083']).
+
+tunnel(Proxy, _) :-
+    member(Proxy, ['localhost:8081', 'localhost:8082', 'localhost:8083']),
+    healthy(Proxy).
@@ -0,0 +1,13 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 https://httpbin.org/ip
+listen(':8080').
+
+% The echo service to discover the exit IPs of proxies. It responds with {"origin": "203.0.113.1"}.
+exit_ip_url('https://httpbin.org/ip').
+
+% Similar to 00_sequential.pl, but skips proxies exiting from the same IP as a proxy used in the last 60 seconds.
+% The exit IP of each proxy is rediscovered every 10 minutes.
+tunnel(Proxy, _) :-
+    member(Proxy, ['localhost:8081', 'localhost:8082', 'localhost:8083']),
+    exit_ip(Proxy, IP, [cache(600)]),
+    \+ exit_ip_used(IP, 60).
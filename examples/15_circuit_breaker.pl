@@ -0,0 +1,15 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 https://httpbin.org/ip
+listen(':8080').
+
+% Skips a proxy for 30 seconds after 3 failures in a row, then tries it again with a single request.
+circuit_breaker(3, 30).
+
+% Similar to 00_sequential.pl, but prefers proxies which haven't failed recently.
+tunnel(Proxy, _) :-
+    member(Proxy, ['localhost:8081', 'localhost:8082', 'localhost:8083']),
+    circuit(Proxy, closed).
+
+tunnel(Proxy, _) :-
+    member(Proxy, ['localhost:8081', 'localhost:8082', 'localhost:8083']),
+    \+ circuit(Proxy, closed).
@@ -0,0 +1,15 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 https://httpbin.org/ip
+listen(':8080').
+
+tunnel('localhost:8081', _).
+tunnel('localhost:8082', _).
+
+% localhost:8081 is far away, so it's given more time to connect and to respond to CONNECT.
+proxy_option('localhost:8081', timeout(connect, 5000)).
+proxy_option('localhost:8081', timeout(handshake, 10000)).
+
+% The others fail over quickly. Tunnels via any proxy are closed after 5 minutes without traffic.
+proxy_option(_, timeout(connect, 1000)).
+proxy_option(_, timeout(handshake, 2000)).
+proxy_option(_, timeout(idle, 300000)).
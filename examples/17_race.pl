@@ -0,0 +1,12 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 https://httpbin.org/ip
+%   curl -x fast@localhost:8080 https://httpbin.org/ip
+listen(':8080').
+
+% Races 2 proxies at a time, starting 100ms apart, for requests tagged with fast.
+% The other requests try the proxies one after another.
+race(Options, 2, 100) :-
+    member(fast, Options).
+
+tunnel(Proxy, _) :-
+    member(Proxy, ['localhost:8081', 'localhost:8082', 'localhost:8083']).
@@ -0,0 +1,12 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 https://httpbin.org/ip
+listen(':8080').
+
+% The provider allows 10 concurrent connections per port. Up to 20 requests wait for 5 seconds for a connection via
+% localhost:8081 to be released.
+max_connections('localhost:8081', 10, [queue(20), timeout(5000)]).
+max_connections('localhost:8082', 10).
+
+% Prefers the proxy with fewer live connections.
+tunnel(Proxy, _) :-
+    least_connections(['localhost:8081', 'localhost:8082'], Proxy).
@@ -0,0 +1,17 @@
+% The proxy manager will be available at localhost:8080.
+%   curl -x localhost:8080 https://httpbin.org/ip
+%   curl -x fast@localhost:8080 https://httpbin.org/ip
+listen(':8080').
+
+% Requests tagged with fast prefer the proxy with the lowest handshake latency, skipping the ones failing often.
+tunnel(Proxy, Options) :-
+    member(fast, Options),
+    !,
+    fastest(['localhost:8081', 'localhost:8082', 'localhost:8083'], Proxy),
+    proxy_stats(Proxy, Stats),
+    member(failure_rate(Rate), Stats),
+    Rate < 0.5.
+
+% The other requests prefer the proxy with the fewest live connections.
+tunnel(Proxy, _) :-
+    least_connections(['localhost:8081', 'localhost:8082', 'localhost:8083'], Proxy).
@@ -0,0 +1,167 @@
+package proxima
+
+import (
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+)
+
+// defaultExitIPCache is how long exit_ip/4 reuses the exit IP of a proxy unless cache(Seconds) is given.
+const defaultExitIPCache = 5 * time.Minute
+
+// exitIPKeyPrefix namespaces the keys of exit IPs in probeCache.
+const exitIPKeyPrefix = "exit_ip\x00"
+
+// ipCandidate matches the substrings of a response body which may be IP addresses.
+var ipCandidate = regexp.MustCompile(`[0-9A-Fa-f:.]+`)
+
+// exitIPs keeps track of the exit IPs of proxies and when each exit IP was used last.
+type exitIPs struct {
+	mu        sync.Mutex
+	proxies   map[string]exitIP
+	used      map[string]time.Time
+	nextSweep time.Time
+}
+
+// exitIP is the exit IP of a proxy and when the proxy was discovered or used last.
+type exitIP struct {
+	ip   string
+	last time.Time
+}
+
+func newExitIPs() *exitIPs {
+	return &exitIPs{
+		proxies: map[string]exitIP{},
+		used:    map[string]time.Time{},
+	}
+}
+
+// discovered records that the proxy exits from the IP.
+func (e *exitIPs) discovered(proxy, ip string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	e.sweep(now)
+	e.proxies[proxy] = exitIP{ip: ip, last: now}
+}
+
+// use records that the exit IP of the proxy was used now if it's known.
+func (e *exitIPs) use(proxy string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	x, ok := e.proxies[proxy]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	e.sweep(now)
+	e.proxies[proxy] = exitIP{ip: x.ip, last: now}
+	e.used[x.ip] = now
+}
+
+// sweep removes the proxies and the exit IPs idle for idleProxyTTL once in a while. It must be called with e.mu held.
+func (e *exitIPs) sweep(now time.Time) {
+	if now.Before(e.nextSweep) {
+		return
+	}
+	e.nextSweep = now.Add(sweepInterval)
+
+	for p, x := range e.proxies {
+		if now.Sub(x.last) >= idleProxyTTL {
+			delete(e.proxies, p)
+		}
+	}
+	for ip, t := range e.used {
+		if now.Sub(t) >= idleProxyTTL {
+			delete(e.used, ip)
+		}
+	}
+}
+
+// usedWithin reports whether the exit IP was used within the duration.
+func (e *exitIPs) usedWithin(ip string, d time.Duration) bool {
+	if e == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t, ok := e.used[ip]
+	return ok && time.Since(t) < d
+}
+
+// exitIP discovers the exit IP of the proxy by making an HTTP request to the echo service at url via the proxy.
+// The result is cached for cache(Seconds) in the options or defaultExitIPCache.
+func (s *Switcher) exitIP(proxy, url, options, ip engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+	name, c, req, conf, err := newProbe(proxy, url, options, env)
+	if err != nil {
+		return engine.Error(err)
+	}
+	defer c.CloseIdleConnections()
+
+	if conf.cache == 0 {
+		conf.cache = defaultExitIPCache
+		if conf.negativeCache == 0 {
+			conf.negativeCache = defaultNegativeCache
+		}
+	}
+
+	// Exit IPs are cached apart from probe/4 with the same request which may have another TTL.
+	r, err := s.probes.do(exitIPKeyPrefix+probeKey(name, req, conf), conf.cache, conf.negativeCache, probeFunc(s.Metrics, name, c, req, conf))
+	if err != nil || r.status/100 != 2 {
+		return engine.Bool(false)
+	}
+
+	addr := parseIP(r.body)
+	if addr == nil {
+		return engine.Bool(false)
+	}
+
+	s.exits.discovered(name, addr.String())
+	s.Metrics.exitIP(redact(name), addr.String())
+	s.Admin.exitIP(redact(name), addr.String())
+
+	return engine.Unify(ip, engine.Atom(addr.String()), k, env)
+}
+
+// exitIPUsed succeeds iff a request was sent from the exit IP within the number of seconds.
+func (s *Switcher) exitIPUsed(ip, window engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+	var addr string
+	switch i := env.Resolve(ip).(type) {
+	case engine.Variable:
+		return engine.Error(engine.ErrInstantiation)
+	case engine.Atom:
+		addr = string(i)
+	default:
+		return engine.Error(engine.TypeErrorAtom(ip))
+	}
+
+	d, err := seconds(env.Resolve(window))
+	if err != nil {
+		return engine.Error(err)
+	}
+
+	if !s.exits.usedWithin(addr, d) {
+		return engine.Bool(false)
+	}
+	return k(env)
+}
+
+// parseIP finds the first IP address in the response body of an echo service, either in plain text or in JSON such as
+// {"origin": "203.0.113.1"}.
+func parseIP(body string) net.IP {
+	for _, s := range ipCandidate.FindAllString(body, -1) {
+		if ip := net.ParseIP(s); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package proxima
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoProxy returns a stand-in for a proxy which responds to every request as an echo service exiting from ip.
+func echoProxy(t *testing.T, ip string, calls *int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "http://echo.test/ip", r.URL.String())
+		atomic.AddInt32(calls, 1)
+		_, _ = fmt.Fprintf(w, `{"origin": "%s"}`, ip)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSwitcher_ExitIP(t *testing.T) {
+	var calls int32
+	a := echoProxy(t, "203.0.113.1", &calls)
+	b := echoProxy(t, "203.0.113.1", &calls)
+	c := echoProxy(t, "203.0.113.2", &calls)
+
+	s := newTestSwitcher(t, fmt.Sprintf(`
+exit_ip_url('http://echo.test/ip').
+
+fresh(Proxy) :-
+    member(Proxy, ['%s', '%s', '%s']),
+    exit_ip(Proxy, IP),
+    \+ exit_ip_used(IP, 60).
+`, a.URL, b.URL, c.URL))
+	s.Metrics = NewMetrics()
+	s.Admin = NewAdmin("secret")
+
+	var sol struct {
+		IP string
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, s.QuerySolution(`exit_ip(?, IP).`, a.URL).Scan(&sol))
+		assert.Equal(t, "203.0.113.1", sol.IP)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "cached")
+
+	// probe/4 doesn't share the cache with exit_ip/2.
+	assert.NoError(t, s.QuerySolution(`probe(?, 'http://echo.test/ip', [cache(10)], 200).`, a.URL).Err())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	var fresh struct {
+		Proxies []string
+	}
+	assert.NoError(t, s.QuerySolution(`findall(P, fresh(P), Proxies).`).Scan(&fresh))
+	assert.Equal(t, []string{a.URL, b.URL, c.URL}, fresh.Proxies)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	// b exits from the same IP as a.
+	s.exits.use(a.URL)
+	assert.NoError(t, s.QuerySolution(`findall(P, fresh(P), Proxies).`).Scan(&fresh))
+	assert.Equal(t, []string{c.URL}, fresh.Proxies)
+
+	exits := map[string]string{}
+	for _, p := range s.Admin.Proxies() {
+		exits[p.Proxy] = p.ExitIP
+	}
+	assert.Equal(t, map[string]string{a.URL: "203.0.113.1", b.URL: "203.0.113.1", c.URL: "203.0.113.2"}, exits)
+
+	var text strings.Builder
+	assert.NoError(t, s.Metrics.WriteText(&text))
+	assert.Contains(t, text.String(), fmt.Sprintf(`proxima_proxy_exit_ip_info{proxy="%s",ip="203.0.113.2"} 1`, c.URL))
+
+	t.Run("not an IP", func(t *testing.T) {
+		d := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, "hello")
+		}))
+		defer d.Close()
+
+		assert.Error(t, s.QuerySolution(`exit_ip(?, IP).`, d.URL).Err())
+	})
+
+	t.Run("window is not a number", func(t *testing.T) {
+		assert.Error(t, s.QuerySolution(`exit_ip_used('203.0.113.1', foo).`).Err())
+	})
+}
+
+func TestParseIP(t *testing.T) {
+	tests := []struct {
+		body string
+		ip   string
+	}{
+		{body: "203.0.113.1\n", ip: "203.0.113.1"},
+		{body: `{"origin": "203.0.113.1"}`, ip: "203.0.113.1"},
+		{body: `{"origin": "203.0.113.1, 198.51.100.1"}`, ip: "203.0.113.1"},
+		{body: `{"ip":"2001:db8::1"}`, ip: "2001:db8::1"},
+		{body: "deadbeef", ip: "<nil>"},
+		{body: "", ip: "<nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			assert.Equal(t, tt.ip, parseIP(tt.body).String())
+		})
+	}
+}
+
+func TestExitIPs_Sweep(t *testing.T) {
+	e := newExitIPs()
+	e.discovered("http://localhost:8081", "203.0.113.1")
+	e.use("http://localhost:8081")
+	assert.True(t, e.usedWithin("203.0.113.1", time.Minute))
+
+	e.proxies["http://localhost:8081"] = exitIP{ip: "203.0.113.1", last: time.Now().Add(-idleProxyTTL)}
+	e.used["203.0.113.1"] = time.Now().Add(-idleProxyTTL)
+	e.nextSweep = time.Time{}
+
+	e.discovered("http://localhost:8082", "203.0.113.2")
+	assert.Equal(t, map[string]exitIP{"http://localhost:8082": e.proxies["http://localhost:8082"]}, e.proxies)
+	assert.Empty(t, e.used)
+}
@@ -0,0 +1,370 @@
+package proxima
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ichiban/prolog"
+	"github.com/ichiban/prolog/engine"
+)
+
+var (
+	errInvalidClause = errors.New("invalid clause")
+	errNoClause      = errors.New("no matching clause")
+)
+
+// Facts changes clauses of dynamic predicates at runtime. *Reloader implements it.
+type Facts interface {
+	// Assert adds the clause at the end of its dynamic predicate.
+	Assert(ctx context.Context, clause string) error
+	// Retract removes the first clause unifying with the clause from its dynamic predicate.
+	Retract(ctx context.Context, clause string) error
+	// Dump writes the clauses of all the dynamic predicates.
+	Dump(ctx context.Context, w io.Writer) error
+}
+
+// overlay is the snapshot of the dynamic predicates changed at runtime. It replaces their clauses on every reload.
+type overlay map[engine.ProcedureIndicator][]engine.Term
+
+// Persist loads the changes made at runtime from file if it exists and saves the changes to file from now on.
+func (r *Reloader) Persist(ctx context.Context, file string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o := overlay{}
+	b, err := ioutil.ReadFile(file)
+	switch {
+	case err == nil:
+		if o, err = parseOverlay(r.Switcher(), string(b)); err != nil {
+			return err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		break
+	default:
+		return err
+	}
+
+	s, err := r.load(ctx, r.texts, o)
+	if err != nil {
+		return err
+	}
+
+	r.current.Store(s)
+	r.overlay = o
+	r.persist = file
+	return nil
+}
+
+// Assert adds the clause at the end of its dynamic predicate and swaps in a new Switcher with the change.
+func (r *Reloader) Assert(ctx context.Context, clause string) error {
+	return r.change(ctx, clause, "assertz")
+}
+
+// Retract removes the first clause unifying with the clause from its dynamic predicate and swaps in a new Switcher
+// with the change.
+func (r *Reloader) Retract(ctx context.Context, clause string) error {
+	return r.change(ctx, clause, "retract")
+}
+
+// Dump writes the clauses of all the dynamic predicates of the current Switcher.
+func (r *Reloader) Dump(ctx context.Context, w io.Writer) error {
+	return r.Switcher().dump(ctx, w)
+}
+
+// change applies the clause to a new Switcher with op, which is either assertz or retract. Since the interpreter
+// can't be modified while serving requests, it loads a new Switcher with the change instead.
+func (r *Reloader) change(ctx context.Context, clause, op string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, err := parseClause(r.Switcher(), clause)
+	if err != nil {
+		return err
+	}
+	pi, err := clauseIndicator(t)
+	if err != nil {
+		return err
+	}
+	if !r.Switcher().dynamic(ctx, pi) {
+		return fmt.Errorf("%w: %s is not dynamic", errInvalidClause, pi)
+	}
+
+	s, err := r.load(ctx, r.texts, r.overlay)
+	if err != nil {
+		return err
+	}
+
+	if err := s.QuerySolutionContext(ctx, op+`(?).`, t).Err(); err != nil {
+		if op == "retract" && errors.Is(err, prolog.ErrNoSolutions) {
+			return errNoClause
+		}
+		return err
+	}
+	if err := s.configure(); err != nil {
+		return err
+	}
+
+	cs, err := s.clauses(ctx, pi)
+	if err != nil {
+		return err
+	}
+	o := overlay{}
+	for k, v := range r.overlay {
+		o[k] = v
+	}
+	o[pi] = cs
+
+	if r.persist != "" {
+		if err := o.save(s, r.persist); err != nil {
+			return err
+		}
+	}
+
+	r.current.Store(s)
+	r.overlay = o
+	return nil
+}
+
+// parseClause parses a single clause. The period at the end is optional.
+func parseClause(s *Switcher, clause string) (engine.Term, error) {
+	clause = strings.TrimSpace(clause)
+	if !strings.HasSuffix(clause, ".") {
+		clause += "."
+	}
+
+	p := s.Parser(strings.NewReader(clause), nil)
+	t, err := p.Term()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidClause, err)
+	}
+	if p.More() {
+		return nil, fmt.Errorf("%w: more than one clause", errInvalidClause)
+	}
+	return t, nil
+}
+
+// clauseIndicator returns the procedure indicator of the head of the clause.
+func clauseIndicator(t engine.Term) (engine.ProcedureIndicator, error) {
+	head := t
+	if c, ok := t.(*engine.Compound); ok && c.Functor == ":-" {
+		if len(c.Args) != 2 {
+			return engine.ProcedureIndicator{}, fmt.Errorf("%w: directive", errInvalidClause)
+		}
+		head = c.Args[0]
+	}
+
+	switch h := head.(type) {
+	case engine.Atom:
+		return engine.ProcedureIndicator{Name: h, Arity: 0}, nil
+	case *engine.Compound:
+		return engine.ProcedureIndicator{Name: h.Functor, Arity: engine.Integer(len(h.Args))}, nil
+	default:
+		return engine.ProcedureIndicator{}, fmt.Errorf("%w: head is not callable", errInvalidClause)
+	}
+}
+
+// dynamic reports whether the predicate is declared dynamic.
+func (s *Switcher) dynamic(ctx context.Context, pi engine.ProcedureIndicator) bool {
+	if s.QuerySolutionContext(ctx, `current_predicate(?).`, pi.Term()).Err() != nil {
+		return false
+	}
+	// clause/2 raises a permission error unless the predicate is dynamic.
+	_, err := s.clauses(ctx, pi)
+	return err == nil
+}
+
+// clauses returns the clauses of the dynamic predicate. Facts are returned as their heads.
+func (s *Switcher) clauses(ctx context.Context, pi engine.ProcedureIndicator) ([]engine.Term, error) {
+	args := make([]engine.Term, pi.Arity)
+	for i := range args {
+		args[i] = engine.NewVariable()
+	}
+	head, err := pi.Apply(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	sols, err := s.QueryContext(ctx, `Head = ?, clause(Head, Body).`, head)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = sols.Close()
+	}()
+
+	var cs []engine.Term
+	for sols.Next() {
+		var sol struct {
+			Head engine.Term
+			Body engine.Term
+		}
+		if err := sols.Scan(&sol); err != nil {
+			return nil, err
+		}
+		if sol.Body == engine.Atom("true") {
+			cs = append(cs, sol.Head)
+			continue
+		}
+		cs = append(cs, engine.Atom(":-").Apply(sol.Head, sol.Body))
+	}
+	return cs, sols.Err()
+}
+
+// dump writes the clauses of all the dynamic predicates sorted by their indicators.
+func (s *Switcher) dump(ctx context.Context, w io.Writer) error {
+	pis, err := s.indicators(ctx)
+	if err != nil {
+		return err
+	}
+
+	o := overlay{}
+	for _, pi := range pis {
+		cs, err := s.clauses(ctx, pi)
+		if err != nil {
+			// Not dynamic.
+			continue
+		}
+		o[pi] = cs
+	}
+	return o.write(s, w, false)
+}
+
+// indicators returns the indicators of the predicates defined by clauses.
+func (s *Switcher) indicators(ctx context.Context) ([]engine.ProcedureIndicator, error) {
+	sols, err := s.QueryContext(ctx, `current_predicate(PI).`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = sols.Close()
+	}()
+
+	var pis []engine.ProcedureIndicator
+	for sols.Next() {
+		var sol struct {
+			PI engine.Term
+		}
+		if err := sols.Scan(&sol); err != nil {
+			return nil, err
+		}
+		pi, err := engine.NewProcedureIndicator(sol.PI, nil)
+		if err != nil {
+			return nil, err
+		}
+		pis = append(pis, pi)
+	}
+	return pis, sols.Err()
+}
+
+// write writes the dynamic predicates in o as Prolog text. If replace is true, the clauses of each predicate replace
+// the existing ones when the text is consulted.
+func (o overlay) write(s *Switcher, w io.Writer, replace bool) error {
+	pis := make([]engine.ProcedureIndicator, 0, len(o))
+	for pi := range o {
+		pis = append(pis, pi)
+	}
+	sortIndicators(pis)
+
+	for _, pi := range pis {
+		if _, err := fmt.Fprintf(w, ":- dynamic(%s).\n", pi); err != nil {
+			return err
+		}
+		if replace {
+			args := make([]engine.Term, pi.Arity)
+			for i := range args {
+				args[i] = engine.NewVariable()
+			}
+			head, err := pi.Apply(args...)
+			if err != nil {
+				return err
+			}
+			if err := writeClause(s, w, engine.Atom("retractall").Apply(head), true); err != nil {
+				return err
+			}
+		}
+		for _, c := range o[pi] {
+			if err := writeClause(s, w, c, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// save writes o to file atomically.
+func (o overlay) save(s *Switcher, file string) error {
+	var b strings.Builder
+	if err := o.write(s, &b, true); err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// parseOverlay parses the text written by overlay.save.
+func parseOverlay(s *Switcher, text string) (overlay, error) {
+	o := overlay{}
+	p := s.Parser(strings.NewReader(text), nil)
+	for p.More() {
+		t, err := p.Term()
+		if err != nil {
+			return nil, err
+		}
+
+		if c, ok := t.(*engine.Compound); ok && c.Functor == ":-" && len(c.Args) == 1 {
+			// Each predicate starts with :- dynamic(PI). and :- retractall(Head).
+			if d, ok := c.Args[0].(*engine.Compound); ok && d.Functor == "retractall" && len(d.Args) == 1 {
+				pi, err := clauseIndicator(d.Args[0])
+				if err != nil {
+					return nil, err
+				}
+				o[pi] = []engine.Term{}
+			}
+			continue
+		}
+
+		pi, err := clauseIndicator(t)
+		if err != nil {
+			return nil, err
+		}
+		o[pi] = append(o[pi], t)
+	}
+	return o, nil
+}
+
+// writeClause writes t followed by a period. If directive is true, it's written as a directive.
+func writeClause(s *Switcher, w io.Writer, t engine.Term, directive bool) error {
+	var b strings.Builder
+	if directive {
+		b.WriteString(":- ")
+	}
+	if err := engine.Write(&b, t, nil, engine.WithQuoted(true), s.WithIgnoreOps(false)); err != nil {
+		return err
+	}
+	// Keep the period from being a part of a symbolic atom, e.g. `a :- b = +`.
+	if strings.ContainsAny(b.String()[b.Len()-1:], "+-*/\\^<>=~:.?@#&$") {
+		b.WriteString(" ")
+	}
+	b.WriteString(".\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func sortIndicators(pis []engine.ProcedureIndicator) {
+	sort.Slice(pis, func(i, j int) bool {
+		if pis[i].Name != pis[j].Name {
+			return pis[i].Name < pis[j].Name
+		}
+		return pis[i].Arity < pis[j].Arity
+	})
+}
@@ -0,0 +1,155 @@
+package proxima
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloader_Assert(t *testing.T) {
+	f := writeConfig(t, `
+listen(':8080').
+:- dynamic(proxy/2).
+proxy(a, 1).
+static_fact(x).
+`)
+
+	r, err := NewReloader(context.Background(), []string{f})
+	assert.NoError(t, err)
+
+	proxies := func() []string {
+		sols, err := r.Switcher().Query(`proxy(P, _).`)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, sols.Close())
+		}()
+		var ps []string
+		for sols.Next() {
+			var sol struct {
+				P string
+			}
+			assert.NoError(t, sols.Scan(&sol))
+			ps = append(ps, sol.P)
+		}
+		return ps
+	}
+
+	t.Run("assert", func(t *testing.T) {
+		s := r.Switcher()
+		assert.NoError(t, r.Assert(context.Background(), `proxy(b, 2).`))
+		assert.NotSame(t, s, r.Switcher())
+		assert.Equal(t, []string{"a", "b"}, proxies())
+	})
+
+	t.Run("retract", func(t *testing.T) {
+		assert.NoError(t, r.Retract(context.Background(), `proxy(a, _)`))
+		assert.Equal(t, []string{"b"}, proxies())
+	})
+
+	t.Run("no matching clause", func(t *testing.T) {
+		assert.True(t, errors.Is(r.Retract(context.Background(), `proxy(z, _)`), errNoClause))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, c := range []string{
+			`static_fact(y).`,
+			`undefined(y).`,
+			`proxy(c, 3). proxy(d, 4).`,
+			`proxy(c,`,
+			`:- halt.`,
+			`1.`,
+		} {
+			assert.True(t, errors.Is(r.Assert(context.Background(), c), errInvalidClause), c)
+		}
+		assert.Equal(t, []string{"b"}, proxies())
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		assert.NoError(t, r.Assert(context.Background(), `circuit_breaker(3, 30)`))
+		assert.NoError(t, r.Assert(context.Background(), `userinfo_syntax(terms)`))
+		assert.Equal(t, circuitConfig{failures: 3, cooldown: 30 * time.Second}, r.Switcher().circuit)
+		assert.True(t, r.Switcher().userinfoTerms)
+
+		assert.NoError(t, r.Retract(context.Background(), `circuit_breaker(_, _)`))
+		assert.NoError(t, r.Retract(context.Background(), `userinfo_syntax(_)`))
+		assert.Equal(t, circuitConfig{}, r.Switcher().circuit)
+		assert.False(t, r.Switcher().userinfoTerms)
+
+		s := r.Switcher()
+		assert.Error(t, r.Assert(context.Background(), `circuit_breaker(0, 30)`))
+		assert.Same(t, s, r.Switcher())
+	})
+
+	t.Run("file edits wait for reload", func(t *testing.T) {
+		b, err := os.ReadFile(f)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(f, append(b, "proxy(z, 9).\n"...), 0600))
+		defer func() {
+			assert.NoError(t, os.WriteFile(f, b, 0600))
+		}()
+
+		assert.NoError(t, r.Assert(context.Background(), `proxy(c, 3)`))
+		assert.Equal(t, []string{"b", "c"}, proxies())
+		assert.NoError(t, r.Retract(context.Background(), `proxy(c, _)`))
+	})
+
+	t.Run("changes survive reloads", func(t *testing.T) {
+		assert.NoError(t, r.Reload(context.Background()))
+		assert.Equal(t, []string{"b"}, proxies())
+	})
+
+	t.Run("dump", func(t *testing.T) {
+		var b bytes.Buffer
+		assert.NoError(t, r.Dump(context.Background(), &b))
+		assert.Contains(t, b.String(), ":- dynamic(proxy/2).\nproxy(b, 2).\n")
+		assert.NotContains(t, b.String(), "static_fact")
+	})
+}
+
+func TestReloader_Persist(t *testing.T) {
+	f := writeConfig(t, `
+listen(':8080').
+:- dynamic(proxy/2).
+proxy(a, 1).
+:- dynamic(rule/1).
+`)
+	facts := filepath.Join(filepath.Dir(f), "facts.pl")
+
+	r, err := NewReloader(context.Background(), []string{f})
+	assert.NoError(t, err)
+	assert.NoError(t, r.Persist(context.Background(), facts))
+	assert.NoError(t, r.Assert(context.Background(), `proxy('http://localhost:8081', 2)`))
+	assert.NoError(t, r.Retract(context.Background(), `proxy(a, 1)`))
+	assert.NoError(t, r.Assert(context.Background(), `rule(X) :- proxy(X, _)`))
+
+	// A new process restores the changes.
+	b, err := os.ReadFile(facts)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "proxy('http://localhost:8081', 2).\n")
+
+	r, err = NewReloader(context.Background(), []string{f})
+	assert.NoError(t, err)
+	assert.NoError(t, r.Persist(context.Background(), facts))
+
+	var sol struct {
+		X string
+	}
+	assert.NoError(t, r.Switcher().QuerySolution(`rule(X).`).Scan(&sol))
+	assert.Equal(t, "http://localhost:8081", sol.X)
+	assert.Error(t, r.Switcher().QuerySolution(`proxy(a, _).`).Err())
+
+	t.Run("settings", func(t *testing.T) {
+		assert.NoError(t, r.Assert(context.Background(), `circuit_breaker(3, 30)`))
+
+		r, err := NewReloader(context.Background(), []string{f})
+		assert.NoError(t, err)
+		assert.NoError(t, r.Persist(context.Background(), facts))
+		assert.Equal(t, circuitConfig{failures: 3, cooldown: 30 * time.Second}, r.Switcher().circuit)
+	})
+}
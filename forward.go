@@ -0,0 +1,62 @@
+package proxima
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are the headers meaningful only for a single transport-level connection.
+// See https://datatracker.ietf.org/doc/html/rfc7230#section-6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Forward sends req in absolute-form to inbound which is supposed to be a connection to an HTTP proxy and returns the response.
+// The response body reads from inbound so inbound has to be kept open until the body is consumed.
+func Forward(inbound io.ReadWriter, req *http.Request, header http.Header) (*http.Response, error) {
+	return roundTrip(inbound, req, header, (*http.Request).WriteProxy)
+}
+
+// Send sends req in origin-form to inbound which is supposed to be a connection to the origin server and returns the response.
+// The response body reads from inbound so inbound has to be kept open until the body is consumed.
+func Send(inbound io.ReadWriter, req *http.Request, header http.Header) (*http.Response, error) {
+	return roundTrip(inbound, req, header, (*http.Request).Write)
+}
+
+func roundTrip(inbound io.ReadWriter, req *http.Request, header http.Header, write func(*http.Request, io.Writer) error) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.Header = header
+	out.Close = true
+
+	if err := write(out, inbound); err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(bufferedReader(inbound), out)
+}
+
+// endToEndHeader returns a copy of h without hop-by-hop headers.
+func endToEndHeader(h http.Header) http.Header {
+	ret := h.Clone()
+	if ret == nil {
+		ret = http.Header{}
+	}
+	for _, f := range ret["Connection"] {
+		for _, k := range strings.Split(f, ",") {
+			ret.Del(strings.TrimSpace(k))
+		}
+	}
+	for _, k := range hopByHopHeaders {
+		ret.Del(k)
+	}
+	return ret
+}
@@ -0,0 +1,96 @@
+package proxima
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForward(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		ins, inc := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, ins.Close())
+			}()
+
+			req, err := http.ReadRequest(bufio.NewReader(ins))
+			assert.NoError(t, err)
+			assert.Equal(t, http.MethodGet, req.Method)
+			assert.Equal(t, "http://example.com/foo", req.RequestURI)
+			assert.Equal(t, "Basic Zm9vOmJhcg==", req.Header.Get("Proxy-Authorization"))
+
+			resp := http.Response{
+				StatusCode:    http.StatusOK,
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				ContentLength: 2,
+				Body:          io.NopCloser(strings.NewReader("ok")),
+			}
+			assert.NoError(t, resp.Write(ins))
+		}()
+		defer func() {
+			assert.NoError(t, inc.Close())
+		}()
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		assert.NoError(t, err)
+
+		resp, err := Forward(inc, req, http.Header{"Proxy-Authorization": []string{"Basic Zm9vOmJhcg=="}})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "ok", string(b))
+	})
+
+	t.Run("inbound doesn't accept a request", func(t *testing.T) {
+		ins, inc := net.Pipe()
+		assert.NoError(t, ins.Close())
+		defer func() {
+			assert.NoError(t, inc.Close())
+		}()
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		assert.NoError(t, err)
+
+		_, err = Forward(inc, req, http.Header{})
+		assert.Error(t, err)
+	})
+
+	t.Run("inbound doesn't reply to a request", func(t *testing.T) {
+		ins, inc := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, ins.Close())
+			}()
+
+			_, err := http.ReadRequest(bufio.NewReader(ins))
+			assert.NoError(t, err)
+		}()
+		defer func() {
+			assert.NoError(t, inc.Close())
+		}()
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		assert.NoError(t, err)
+
+		_, err = Forward(inc, req, http.Header{})
+		assert.Error(t, err)
+	})
+}
+
+func TestEndToEndHeader(t *testing.T) {
+	h := endToEndHeader(http.Header{
+		"Connection":          []string{"close, X-Foo"},
+		"Proxy-Authorization": []string{"Basic Zm9vOmJhcg=="},
+		"X-Foo":               []string{"foo"},
+		"X-Bar":               []string{"bar"},
+	})
+	assert.Equal(t, http.Header{"X-Bar": []string{"bar"}}, h)
+}
@@ -0,0 +1,334 @@
+package proxima
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/rs/zerolog"
+)
+
+// Health statuses of proxies.
+const (
+	HealthUnknown   = "unknown"   // not checked yet or not under health checks
+	HealthHealthy   = "healthy"   // passed the last rise checks in a row
+	HealthUnhealthy = "unhealthy" // failed the last fall checks in a row
+)
+
+const (
+	defaultRise          = 2
+	defaultFall          = 3
+	defaultHealthTimeout = 10 * time.Second
+)
+
+// healthTick is how often HealthChecker looks for health checks due.
+var healthTick = time.Second
+
+// HealthChecker checks the health of proxies declared by health_check/4 in the background.
+type HealthChecker struct {
+	mu     sync.Mutex
+	states map[string]*healthState
+}
+
+type healthState struct {
+	status    string
+	successes int
+	failures  int
+	checking  bool
+	next      time.Time
+}
+
+// NewHealthChecker returns a new HealthChecker.
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{
+		states: map[string]*healthState{},
+	}
+}
+
+// Status returns the health status of the proxy.
+func (h *HealthChecker) Status(proxy string) string {
+	if h == nil {
+		return HealthUnknown
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.states[proxy]
+	if !ok {
+		return HealthUnknown
+	}
+	return st.status
+}
+
+// Run checks the health of proxies declared by health_check/4 of the current Switcher of r until ctx is done.
+func (h *HealthChecker) Run(ctx context.Context, r *Reloader) {
+	if h == nil {
+		return
+	}
+	t := time.NewTicker(healthTick)
+	defer t.Stop()
+	for {
+		h.tick(ctx, r.Switcher())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// healthCheck is a health check declared by health_check(Proxy, URL, IntervalSeconds, Options).
+type healthCheck struct {
+	proxy    string
+	url      string
+	interval time.Duration
+	timeout  time.Duration // bounds the probe along with timeout(Ms) in the options
+	rise     int
+	fall     int
+	options  engine.Term
+}
+
+// tick starts the health checks due and forgets the proxies no longer checked.
+func (h *HealthChecker) tick(ctx context.Context, s *Switcher) {
+	log := zerolog.Nop()
+	if l, ok := ctx.Value(LogKey).(*zerolog.Logger); ok {
+		log = *l
+	}
+
+	checks, err := s.healthChecks(ctx)
+	if err != nil {
+		log.Err(err).Msg("s.healthChecks() failed")
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	checked := map[string]bool{}
+	for _, c := range checks {
+		if checked[c.proxy] {
+			continue
+		}
+		checked[c.proxy] = true
+
+		st, ok := h.states[c.proxy]
+		if !ok {
+			st = &healthState{status: HealthUnknown}
+			h.states[c.proxy] = st
+		}
+		if st.checking || now.Before(st.next) {
+			continue
+		}
+		st.checking = true
+		st.next = now.Add(c.interval)
+
+		go func(c healthCheck) {
+			status, err := c.probe(ctx)
+			h.report(log.With().Str("proxy", c.proxy).Logger(), c, status, err)
+		}(c)
+	}
+
+	for p, st := range h.states {
+		if !checked[p] && !st.checking {
+			delete(h.states, p)
+		}
+	}
+}
+
+// report updates the health of the proxy with the result of the check.
+func (h *HealthChecker) report(log zerolog.Logger, c healthCheck, status int, err error) {
+	if err == nil && status/100 != 2 {
+		err = fmt.Errorf("unexpected status: %d", status)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.states[c.proxy]
+	if !ok {
+		return
+	}
+	st.checking = false
+
+	prev := st.status
+	if err == nil {
+		st.successes++
+		st.failures = 0
+		// The first result decides the initial status.
+		if prev == HealthUnknown || st.successes >= c.rise {
+			st.status = HealthHealthy
+		}
+	} else {
+		st.failures++
+		st.successes = 0
+		if prev == HealthUnknown || st.failures >= c.fall {
+			st.status = HealthUnhealthy
+		}
+	}
+
+	if st.status != prev {
+		log.Info().Err(err).Str("from", prev).Str("to", st.status).Msg("health changed")
+	}
+}
+
+// statuses returns the proxies and their health statuses sorted by proxy.
+func (h *HealthChecker) statuses() [][2]string {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ss := make([][2]string, 0, len(h.states))
+	for p, st := range h.states {
+		ss = append(ss, [2]string{p, st.status})
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i][0] < ss[j][0]
+	})
+	return ss
+}
+
+// health unifies the proxy and its health status. If the proxy is a variable, it enumerates the proxies under
+// health checks.
+func (h *HealthChecker) health(proxy, status engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+	switch p := env.Resolve(proxy).(type) {
+	case engine.Variable:
+		ss := h.statuses()
+		ks := make([]func(context.Context) *engine.Promise, len(ss))
+		for i := range ss {
+			s := ss[i]
+			ks[i] = func(context.Context) *engine.Promise {
+				given := engine.Compound{Args: []engine.Term{proxy, status}}
+				actual := engine.Compound{Args: []engine.Term{engine.Atom(s[0]), engine.Atom(s[1])}}
+				return engine.Unify(&given, &actual, k, env)
+			}
+		}
+		return engine.Delay(ks...)
+	case engine.Atom:
+		return engine.Unify(status, engine.Atom(h.Status(string(p))), k, env)
+	default:
+		return engine.Error(engine.TypeErrorAtom(proxy))
+	}
+}
+
+// healthChecks returns the health checks declared by health_check/4.
+func (s *Switcher) healthChecks(ctx context.Context) ([]healthCheck, error) {
+	sols, err := s.QueryContext(ctx, `health_check(Proxy, URL, Interval, Options).`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = sols.Close()
+	}()
+
+	var cs []healthCheck
+	for sols.Next() {
+		var sol struct {
+			Proxy    string
+			URL      string
+			Interval engine.Term
+			Options  engine.Term
+		}
+		if err := sols.Scan(&sol); err != nil {
+			return nil, err
+		}
+
+		interval, err := seconds(sol.Interval)
+		if err != nil {
+			return nil, err
+		}
+		c := healthCheck{
+			proxy:    sol.Proxy,
+			url:      sol.URL,
+			interval: interval,
+			timeout:  defaultHealthTimeout,
+			rise:     defaultRise,
+			fall:     defaultFall,
+			options:  sol.Options,
+		}
+		if c.timeout > interval {
+			c.timeout = interval
+		}
+		if err := c.parseOptions(); err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, sols.Err()
+}
+
+// parseOptions reads rise(N) and fall(N) in the options. The rest are probe options.
+func (c *healthCheck) parseOptions() error {
+	iter := engine.ListIterator{List: c.options}
+	for iter.Next() {
+		o, ok := iter.Current().(*engine.Compound)
+		if !ok || len(o.Args) != 1 {
+			continue
+		}
+		switch o.Functor {
+		case "rise", "fall":
+			n, ok := o.Args[0].(engine.Integer)
+			if !ok || n <= 0 {
+				return engine.DomainError("positive_integer", o.Args[0])
+			}
+			if o.Functor == "rise" {
+				c.rise = int(n)
+			} else {
+				c.fall = int(n)
+			}
+		}
+	}
+	return iter.Err()
+}
+
+// probe makes an HTTP request to the URL via the proxy and returns the status code.
+func (c *healthCheck) probe(ctx context.Context) (int, error) {
+	u, err := ParseURL(c.proxy)
+	if err != nil {
+		return 0, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyURL(u)
+	defer t.CloseIdleConnections()
+	cl := http.Client{Transport: t}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	conf, err := probeOptions(&cl, req, c.options, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := doProbe(&cl, req, conf)
+	if err != nil {
+		return 0, err
+	}
+	return r.status, nil
+}
+
+// seconds converts a positive number of seconds into a duration.
+func seconds(t engine.Term) (time.Duration, error) {
+	var d time.Duration
+	switch n := t.(type) {
+	case engine.Integer:
+		d = time.Duration(n) * time.Second
+	case engine.Float:
+		d = time.Duration(float64(n) * float64(time.Second))
+	default:
+		return 0, engine.TypeError("number", t)
+	}
+	if d <= 0 {
+		return 0, engine.DomainError("positive_number", t)
+	}
+	return d, nil
+}
@@ -0,0 +1,94 @@
+package proxima
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecker_Run(t *testing.T) {
+	defer func(tick time.Duration) {
+		healthTick = tick
+	}(healthTick)
+	healthTick = 10 * time.Millisecond
+
+	var status int32 = http.StatusOK
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "http://example.com/health", r.URL.String())
+		assert.Equal(t, "foo", r.Header.Get("X-Probe"))
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer proxy.Close()
+
+	f := writeConfig(t, fmt.Sprintf(`
+listen(':8080').
+health_check('%s', 'http://example.com/health', 0.02, [fall(2), 'X-Probe'-[foo]]).
+`, proxy.URL))
+
+	r, err := NewReloader(context.Background(), []string{f})
+	assert.NoError(t, err)
+	h := NewHealthChecker()
+	r.Switcher().Health = h
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx, r)
+
+	healthy := func() bool {
+		return r.Switcher().QuerySolution(`healthy(?).`, proxy.URL).Err() == nil
+	}
+
+	assert.Eventually(t, healthy, 5*time.Second, 10*time.Millisecond)
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	assert.Eventually(t, func() bool {
+		return h.Status(proxy.URL) == HealthUnhealthy
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, healthy())
+
+	var sol struct {
+		Proxy  string
+		Status string
+	}
+	assert.NoError(t, r.Switcher().QuerySolution(`health(Proxy, Status).`).Scan(&sol))
+	assert.Equal(t, proxy.URL, sol.Proxy)
+	assert.Equal(t, HealthUnhealthy, sol.Status)
+
+	assert.NoError(t, r.Switcher().QuerySolution(`health('http://localhost:1', Status).`).Scan(&sol))
+	assert.Equal(t, HealthUnknown, sol.Status)
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	assert.Eventually(t, healthy, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHealthChecker_Report(t *testing.T) {
+	h := NewHealthChecker()
+	c := healthCheck{proxy: "http://localhost:8081", rise: 2, fall: 3}
+	report := func(err error) string {
+		h.states[c.proxy].checking = true
+		h.report(zerolog.Nop(), c, http.StatusOK, err)
+		return h.Status(c.proxy)
+	}
+	h.states[c.proxy] = &healthState{status: HealthUnknown}
+
+	// The first result decides the initial status.
+	assert.Equal(t, HealthHealthy, report(nil))
+
+	fail := errors.New("connection refused")
+	assert.Equal(t, HealthHealthy, report(fail))
+	assert.Equal(t, HealthHealthy, report(fail))
+	assert.Equal(t, HealthUnhealthy, report(fail))
+
+	assert.Equal(t, HealthUnhealthy, report(nil))
+	assert.Equal(t, HealthUnhealthy, report(fail))
+	assert.Equal(t, HealthUnhealthy, report(nil))
+	assert.Equal(t, HealthHealthy, report(nil))
+}
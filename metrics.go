@@ -0,0 +1,332 @@
+package proxima
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ichiban/prolog"
+)
+
+// Reasons why attempts to proxies fail.
+const (
+	FailureDial      = "dial"      // failed to connect to the proxy
+	FailureHandshake = "handshake" // failed to ask the proxy to connect to the target
+	FailureStatus    = "status"    // the proxy responded with an unsuccessful status
+	FailureHijack    = "hijack"    // failed to take over the client connection
+	FailureForward   = "forward"   // failed to forward a plain HTTP request
+)
+
+const (
+	// maxProxyLabels is the maximum number of distinct proxies in the proxy label.
+	maxProxyLabels = 1000
+	// otherProxyLabel is the proxy label for the proxies beyond maxProxyLabels.
+	otherProxyLabel = "other"
+)
+
+// Metrics collects metrics of Switchers and exposes them in Prometheus text format.
+type Metrics struct {
+	mu       sync.Mutex
+	requests *metricVec
+	attempts *metricVec
+	failures *metricVec
+	active   *metricVec
+	bytes    *metricVec
+	probes   *metricVec
+	exitIPs  *metricVec
+	query    *histogram
+	proxies  map[string]struct{}
+}
+
+// NewMetrics returns a new Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newMetricVec("proxima_requests_total", "counter", "Requests by protocol and status.", "protocol", "status"),
+		attempts: newMetricVec("proxima_proxy_attempts_total", "counter", "Attempts to connect via proxies.", "proxy"),
+		failures: newMetricVec("proxima_proxy_failures_total", "counter", "Failed attempts to connect via proxies by reason.", "proxy", "reason"),
+		active:   newMetricVec("proxima_active_tunnels", "gauge", "Tunnels in progress.", "proxy"),
+		bytes:    newMetricVec("proxima_proxy_bytes_total", "counter", "Bytes transferred through tunnels by direction.", "proxy", "direction"),
+		probes:   newMetricVec("proxima_probes_total", "counter", "Results of probe/4 by status.", "proxy", "status"),
+		exitIPs:  newMetricVec("proxima_proxy_exit_ip_info", "gauge", "Exit IPs of proxies discovered by exit_ip/2.", "proxy", "ip"),
+		proxies:  map[string]struct{}{},
+		query:    newHistogram("proxima_tunnel_query_duration_seconds", "Time spent evaluating tunnel/2 per request.", .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5),
+	}
+}
+
+// proxy returns the label value for the proxy. Once there're maxProxyLabels proxies, the rest are labeled as
+// otherProxyLabel so that the number of series stays bounded. It must be called with the lock held.
+func (m *Metrics) proxy(name string) string {
+	if _, ok := m.proxies[name]; ok {
+		return name
+	}
+	if len(m.proxies) >= maxProxyLabels {
+		return otherProxyLabel
+	}
+	m.proxies[name] = struct{}{}
+	return name
+}
+
+func (m *Metrics) request(protocol string, status int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests.add(1, protocol, strconv.Itoa(status))
+}
+
+func (m *Metrics) attempt(proxy string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts.add(1, m.proxy(proxy))
+}
+
+func (m *Metrics) failure(proxy, reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures.add(1, m.proxy(proxy), reason)
+}
+
+func (m *Metrics) tunnelStart(proxy string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active.add(1, m.proxy(proxy))
+}
+
+func (m *Metrics) tunnelFinish(proxy string, stats TunnelStats) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	proxy = m.proxy(proxy)
+	m.active.add(-1, proxy)
+	m.bytes.add(float64(stats.Sent), proxy, "sent")
+	m.bytes.add(float64(stats.Received), proxy, "received")
+}
+
+func (m *Metrics) probe(proxy string, status int, err error) {
+	if m == nil {
+		return
+	}
+	s := strconv.Itoa(status)
+	if err != nil {
+		s = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.probes.add(1, m.proxy(proxy), s)
+}
+
+func (m *Metrics) exitIP(proxy, ip string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	proxy = m.proxy(proxy)
+	m.exitIPs.deletePrefix(proxy)
+	m.exitIPs.add(1, proxy, ip)
+}
+
+func (m *Metrics) queryDuration(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.query.observe(d.Seconds())
+}
+
+// MetricsListener returns the address declared by metrics_listen/1 to expose metrics, or an empty string if not declared.
+func (s *Switcher) MetricsListener(ctx context.Context) (string, error) {
+	var sol struct {
+		Addr string
+	}
+	switch err := s.QuerySolutionContext(ctx, `metrics_listen(Addr).`).Scan(&sol); {
+	case err == nil:
+		return sol.Addr, nil
+	case errors.Is(err, prolog.ErrNoSolutions):
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// failureReason classifies an error of a handshake with a proxy.
+func failureReason(err error) string {
+	var e *StatusError
+	if errors.As(err, &e) {
+		return FailureStatus
+	}
+	return FailureHandshake
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WriteText(w)
+}
+
+// WriteText writes the metrics in Prometheus text format.
+func (m *Metrics) WriteText(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, v := range []*metricVec{m.requests, m.attempts, m.failures, m.active, m.bytes, m.probes, m.exitIPs} {
+		v.write(bw)
+	}
+	m.query.write(bw)
+	return bw.Flush()
+}
+
+// metricVec is a counter or a gauge partitioned by labels.
+type metricVec struct {
+	name   string
+	typ    string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newMetricVec(name, typ, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		typ:    typ,
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+	}
+}
+
+func (v *metricVec) add(delta float64, values ...string) {
+	v.values[strings.Join(values, "\x00")] += delta
+}
+
+// deletePrefix deletes the values of which the leading labels are the values.
+func (v *metricVec) deletePrefix(values ...string) {
+	prefix := strings.Join(values, "\x00") + "\x00"
+	for k := range v.values {
+		if strings.HasPrefix(k, prefix) {
+			delete(v.values, k)
+		}
+	}
+}
+
+func (v *metricVec) write(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		values := strings.Split(k, "\x00")
+		pairs := make([]string, len(v.labels))
+		for i, l := range v.labels {
+			pairs[i] = fmt.Sprintf(`%s="%s"`, l, labelEscaper.Replace(values[i]))
+		}
+		_, _ = fmt.Fprintf(w, "%s{%s} %s\n", v.name, strings.Join(pairs, ","), formatFloat(v.values[k]))
+	}
+}
+
+// histogram is a histogram without labels.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets ...float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		_, _ = fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	_, _ = fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	_, _ = fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statusRecorder remembers the status code of the response.
+// Since tunnels are established before hijacking, hijacking counts as 200 OK.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,95 @@
+package proxima
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_WriteText(t *testing.T) {
+	t.Run("nil", func(t *testing.T) {
+		var m *Metrics
+		m.request("connect", 200)
+		m.attempt("localhost:8081")
+
+		var b bytes.Buffer
+		assert.NoError(t, m.WriteText(&b))
+		assert.Empty(t, b.String())
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		m := NewMetrics()
+		m.request("connect", 200)
+		m.request("connect", 200)
+		m.request("socks5", 502)
+		m.attempt(`a"b`)
+		m.failure("localhost:8081", failureReason(&StatusError{Status: "407 Proxy Authentication Required", StatusCode: 407}))
+		m.failure("localhost:8081", failureReason(errors.New("EOF")))
+		m.tunnelStart("localhost:8082")
+		m.tunnelStart("localhost:8083")
+		m.tunnelFinish("localhost:8083", TunnelStats{Sent: 10, Received: 20})
+		m.probe("localhost:8081", 200, nil)
+		m.probe("localhost:8081", 0, errors.New("timeout"))
+		m.queryDuration(3 * time.Millisecond)
+
+		var b bytes.Buffer
+		assert.NoError(t, m.WriteText(&b))
+		s := b.String()
+		assert.Contains(t, s, "# TYPE proxima_requests_total counter\n")
+		assert.Contains(t, s, `proxima_requests_total{protocol="connect",status="200"} 2`+"\n")
+		assert.Contains(t, s, `proxima_requests_total{protocol="socks5",status="502"} 1`+"\n")
+		assert.Contains(t, s, `proxima_proxy_attempts_total{proxy="a\"b"} 1`+"\n")
+		assert.Contains(t, s, `proxima_proxy_failures_total{proxy="localhost:8081",reason="status"} 1`+"\n")
+		assert.Contains(t, s, `proxima_proxy_failures_total{proxy="localhost:8081",reason="handshake"} 1`+"\n")
+		assert.Contains(t, s, "# TYPE proxima_active_tunnels gauge\n")
+		assert.Contains(t, s, `proxima_active_tunnels{proxy="localhost:8082"} 1`+"\n")
+		assert.Contains(t, s, `proxima_active_tunnels{proxy="localhost:8083"} 0`+"\n")
+		assert.Contains(t, s, `proxima_proxy_bytes_total{proxy="localhost:8083",direction="sent"} 10`+"\n")
+		assert.Contains(t, s, `proxima_proxy_bytes_total{proxy="localhost:8083",direction="received"} 20`+"\n")
+		assert.Contains(t, s, `proxima_probes_total{proxy="localhost:8081",status="200"} 1`+"\n")
+		assert.Contains(t, s, `proxima_probes_total{proxy="localhost:8081",status="error"} 1`+"\n")
+		assert.Contains(t, s, `proxima_tunnel_query_duration_seconds_bucket{le="0.0025"} 0`+"\n")
+		assert.Contains(t, s, `proxima_tunnel_query_duration_seconds_bucket{le="0.005"} 1`+"\n")
+		assert.Contains(t, s, `proxima_tunnel_query_duration_seconds_bucket{le="+Inf"} 1`+"\n")
+		assert.Contains(t, s, "proxima_tunnel_query_duration_seconds_count 1\n")
+	})
+
+	t.Run("too many proxies", func(t *testing.T) {
+		m := NewMetrics()
+		for i := 0; i < maxProxyLabels+2; i++ {
+			m.attempt(fmt.Sprintf("localhost:%d", 10000+i))
+		}
+		m.attempt("localhost:10000")
+
+		var b bytes.Buffer
+		assert.NoError(t, m.WriteText(&b))
+		s := b.String()
+		assert.Contains(t, s, `proxima_proxy_attempts_total{proxy="localhost:10000"} 2`+"\n")
+		assert.Contains(t, s, fmt.Sprintf(`proxima_proxy_attempts_total{proxy="localhost:%d"} 1`, 10000+maxProxyLabels-1)+"\n")
+		assert.Contains(t, s, `proxima_proxy_attempts_total{proxy="other"} 2`+"\n")
+	})
+}
+
+func TestSwitcher_MetricsListener(t *testing.T) {
+	t.Run("declared", func(t *testing.T) {
+		s := newTestSwitcher(t, `metrics_listen(':9090').`)
+
+		addr, err := s.MetricsListener(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, ":9090", addr)
+	})
+
+	t.Run("not declared", func(t *testing.T) {
+		s, err := New(nil)
+		assert.NoError(t, err)
+
+		addr, err := s.MetricsListener(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "", addr)
+	})
+}
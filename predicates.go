@@ -2,9 +2,17 @@ package proxima
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ichiban/prolog/engine"
 	"github.com/jtacoma/uritemplates"
@@ -80,89 +88,338 @@ var clientDo = (*http.Client).Do
 
 // Probe probes by making an HTTP request to the target via the proxy.
 func Probe(proxy, target, options, status engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
-	var c http.Client
+	return probe(nil, defaultProbeCache, proxy, target, options, status, nil, k, env)
+}
+
+// defaultProbeCache is the cache for Probe.
+var defaultProbeCache = newProbeCache()
+
+const (
+	defaultProbeTimeout = 10 * time.Second
+	defaultProbeMaxBody = 4096
+)
+
+var errUnexpectedBody = errors.New("unexpected body")
+
+// probe is Probe which records the results in m and caches them in cache. If result is not nil, it's unified with
+// the list of status(Code), latency(Ms), headers(Pairs), and body(Body).
+func probe(m *Metrics, cache *probeCache, proxy, target, options, status, result engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+	name, c, req, conf, err := newProbe(proxy, target, options, env)
+	if err != nil {
+		return engine.Error(err)
+	}
+	defer c.CloseIdleConnections()
+
+	do := probeFunc(m, name, c, req, conf)
+
+	var r *probeResult
+	if conf.cache > 0 && cache != nil {
+		r, err = cache.do(probeKey(name, req, conf), conf.cache, conf.negativeCache, do)
+	} else {
+		r, err = do()
+	}
+	if err != nil {
+		return engine.Bool(false)
+	}
+
+	if result == nil {
+		return engine.Unify(status, engine.Integer(r.status), k, env)
+	}
+	given := engine.Compound{Args: []engine.Term{status, result}}
+	actual := engine.Compound{Args: []engine.Term{engine.Integer(r.status), r.term()}}
+	return engine.Unify(&given, &actual, k, env)
+}
+
+// newProbe returns the name of the proxy, and the client, the request, and the rest of the options of a probe to the
+// target via the proxy.
+func newProbe(proxy, target, options engine.Term, env *engine.Env) (string, *http.Client, *http.Request, probeConfig, error) {
+	var (
+		c    http.Client
+		name string
+	)
 	switch p := env.Resolve(proxy).(type) {
 	case engine.Variable:
-		return engine.Error(engine.ErrInstantiation)
+		return "", nil, nil, probeConfig{}, engine.ErrInstantiation
 	case engine.Atom:
-		u, err := ParseURL(string(p))
+		name = string(p)
+		u, err := ParseURL(name)
 		if err != nil {
-			return engine.Error(engine.DomainError("url", p))
+			return "", nil, nil, probeConfig{}, engine.DomainError("url", p)
 		}
 
 		t := http.DefaultTransport.(*http.Transport).Clone()
 		t.Proxy = http.ProxyURL(u)
 		c.Transport = t
 	default:
-		return engine.Error(engine.TypeErrorAtom(proxy))
+		return "", nil, nil, probeConfig{}, engine.TypeErrorAtom(proxy)
 	}
 
 	var req *http.Request
 	switch t := env.Resolve(target).(type) {
 	case engine.Variable:
-		return engine.Error(engine.ErrInstantiation)
+		return "", nil, nil, probeConfig{}, engine.ErrInstantiation
 	case engine.Atom:
 		var err error
 		req, err = http.NewRequest(http.MethodGet, string(t), nil)
 		if err != nil {
-			return engine.Error(engine.DomainError("url", t))
+			return "", nil, nil, probeConfig{}, engine.DomainError("url", t)
 		}
 	default:
-		return engine.Error(engine.TypeErrorAtom(t))
+		return "", nil, nil, probeConfig{}, engine.TypeErrorAtom(t)
 	}
 
-	if err := probeOptions(&c, req, options, env); err != nil {
-		return engine.Error(err)
+	conf, err := probeOptions(&c, req, options, env)
+	if err != nil {
+		return "", nil, nil, probeConfig{}, err
+	}
+	return name, &c, req, conf, nil
+}
+
+// probeResult is the response to a probe.
+type probeResult struct {
+	status  int
+	latency time.Duration
+	header  http.Header
+	body    string
+}
+
+// term returns the result as a list of status(Code), latency(Ms), headers(Pairs), and body(Body).
+func (r *probeResult) term() engine.Term {
+	keys := make([]string, 0, len(r.header))
+	for k := range r.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	headers := make([]engine.Term, len(keys))
+	for i, k := range keys {
+		vs := make([]engine.Term, len(r.header[k]))
+		for j, v := range r.header[k] {
+			vs[j] = engine.Atom(v)
+		}
+		headers[i] = engine.Atom("-").Apply(engine.Atom(k), engine.List(vs...))
+	}
+
+	return engine.List(
+		engine.Atom("status").Apply(engine.Integer(r.status)),
+		engine.Atom("latency").Apply(engine.Integer(r.latency.Milliseconds())),
+		engine.Atom("headers").Apply(engine.List(headers...)),
+		engine.Atom("body").Apply(engine.Atom(r.body)),
+	)
+}
+
+// probeFunc returns a function which makes the probe via the proxy and records the result in m.
+func probeFunc(m *Metrics, proxy string, c *http.Client, req *http.Request, conf probeConfig) func() (*probeResult, error) {
+	return func() (*probeResult, error) {
+		r, err := doProbe(c, req, conf)
+		if r == nil {
+			m.probe(redact(proxy), 0, err)
+		} else {
+			m.probe(redact(proxy), r.status, err)
+		}
+		return r, err
 	}
+}
 
-	res, err := clientDo(&c, req)
+// doProbe makes the request and reads the response body up to conf.maxBody.
+// If the body doesn't match conf.expectBody, it returns the result with errUnexpectedBody.
+func doProbe(c *http.Client, req *http.Request, conf probeConfig) (*probeResult, error) {
+	start := time.Now()
+	res, err := clientDo(c, req)
 	if err != nil {
-		return engine.Bool(false)
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	r := probeResult{
+		status:  res.StatusCode,
+		latency: time.Since(start),
+		header:  res.Header,
 	}
-	_ = res.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, conf.maxBody))
+	if err != nil {
+		return nil, err
+	}
+	r.body = string(b)
+
+	if conf.expectBody != nil && !conf.expectBody.Match(b) {
+		return &r, errUnexpectedBody
+	}
+	return &r, nil
+}
 
-	return engine.Unify(status, engine.Integer(res.StatusCode), k, env)
+// probeConfig is the options of probes which don't go into the client or the request.
+type probeConfig struct {
+	// cache is the TTL of 2XX results. Results are not cached if it's zero.
+	cache time.Duration
+	// negativeCache is the TTL of the other results.
+	negativeCache time.Duration
+	// body is the request body.
+	body string
+	// expectBody is the pattern the response body must match if set.
+	expectBody *regexp.Regexp
+	// maxBody is the maximum number of bytes to read from the response body.
+	maxBody int64
+	// timeout, insecure, and followRedirects are applied to the client. They're kept to tell probes apart.
+	timeout         time.Duration
+	insecure        bool
+	followRedirects bool
 }
 
-func probeOptions(_ *http.Client, req *http.Request, pairs engine.Term, env *engine.Env) error {
+// probeOptions applies the options to the client and the request, and returns the rest.
+func probeOptions(c *http.Client, req *http.Request, pairs engine.Term, env *engine.Env) (probeConfig, error) {
+	var (
+		conf        = probeConfig{maxBody: defaultProbeMaxBody, timeout: defaultProbeTimeout, followRedirects: true}
+		negative    time.Duration
+		hasNegative bool
+	)
+	c.Timeout = defaultProbeTimeout
+
 	iter := engine.ListIterator{List: pairs, Env: env}
 	for iter.Next() {
 		elem := iter.Current()
 		switch e := env.Resolve(elem).(type) {
 		case engine.Variable:
-			return engine.ErrInstantiation
+			return conf, engine.ErrInstantiation
 		case *engine.Compound:
-			if e.Functor != "-" || len(e.Args) != 2 {
-				break
-			}
-
-			k, ok := env.Resolve(e.Args[0]).(engine.Atom)
-			if !ok {
-				return engine.TypeErrorAtom(e.Args[0])
+			var arg engine.Term
+			if len(e.Args) == 1 {
+				arg = env.Resolve(e.Args[0])
 			}
+			switch {
+			case e.Functor == "cache" && len(e.Args) == 1:
+				d, err := seconds(arg)
+				if err != nil {
+					return conf, err
+				}
+				conf.cache = d
+			case e.Functor == "negative_cache" && len(e.Args) == 1:
+				d, err := seconds(arg)
+				if err != nil {
+					return conf, err
+				}
+				negative, hasNegative = d, true
+			case e.Functor == "method" && len(e.Args) == 1:
+				m, ok := arg.(engine.Atom)
+				if !ok {
+					return conf, engine.TypeErrorAtom(arg)
+				}
+				req.Method = strings.ToUpper(string(m))
+			case e.Functor == "body" && len(e.Args) == 1:
+				b, ok := arg.(engine.Atom)
+				if !ok {
+					return conf, engine.TypeErrorAtom(arg)
+				}
+				conf.body = string(b)
+				req.Body = ioutil.NopCloser(strings.NewReader(conf.body))
+				req.GetBody = func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader(conf.body)), nil
+				}
+				req.ContentLength = int64(len(conf.body))
+			case e.Functor == "timeout" && len(e.Args) == 1:
+				ms, ok := arg.(engine.Integer)
+				if !ok {
+					return conf, engine.TypeErrorInteger(arg)
+				}
+				if ms <= 0 {
+					return conf, engine.DomainError("positive_integer", arg)
+				}
+				conf.timeout = time.Duration(ms) * time.Millisecond
+				c.Timeout = conf.timeout
+			case e.Functor == "insecure" && len(e.Args) == 1:
+				insecure, err := boolean(arg)
+				if err != nil {
+					return conf, err
+				}
+				conf.insecure = insecure
+				if t, ok := c.Transport.(*http.Transport); ok {
+					if t.TLSClientConfig == nil {
+						t.TLSClientConfig = &tls.Config{}
+					}
+					t.TLSClientConfig.InsecureSkipVerify = insecure
+				}
+			case e.Functor == "follow_redirects" && len(e.Args) == 1:
+				follow, err := boolean(arg)
+				if err != nil {
+					return conf, err
+				}
+				conf.followRedirects = follow
+				c.CheckRedirect = nil
+				if !follow {
+					c.CheckRedirect = func(*http.Request, []*http.Request) error {
+						return http.ErrUseLastResponse
+					}
+				}
+			case e.Functor == "expect_body" && len(e.Args) == 1:
+				p, ok := arg.(engine.Atom)
+				if !ok {
+					return conf, engine.TypeErrorAtom(arg)
+				}
+				re, err := regexp.Compile(string(p))
+				if err != nil {
+					return conf, engine.DomainError("regex", arg)
+				}
+				conf.expectBody = re
+			case e.Functor == "max_body" && len(e.Args) == 1:
+				n, ok := arg.(engine.Integer)
+				if !ok {
+					return conf, engine.TypeErrorInteger(arg)
+				}
+				if n < 0 {
+					return conf, engine.DomainError("not_less_than_zero", arg)
+				}
+				conf.maxBody = int64(n)
+			case e.Functor == "-" && len(e.Args) == 2:
+				k, ok := env.Resolve(e.Args[0]).(engine.Atom)
+				if !ok {
+					return conf, engine.TypeErrorAtom(e.Args[0])
+				}
 
-			var vs []string
-			iter := engine.ListIterator{List: e.Args[1], Env: env}
-			for iter.Next() {
-				switch v := env.Resolve(iter.Current()).(type) {
-				case engine.Variable:
-					return engine.ErrInstantiation
-				case engine.Atom:
-					vs = append(vs, string(v))
-				default:
-					return engine.TypeErrorAtom(v)
+				var vs []string
+				iter := engine.ListIterator{List: e.Args[1], Env: env}
+				for iter.Next() {
+					switch v := env.Resolve(iter.Current()).(type) {
+					case engine.Variable:
+						return conf, engine.ErrInstantiation
+					case engine.Atom:
+						vs = append(vs, string(v))
+					default:
+						return conf, engine.TypeErrorAtom(v)
+					}
 				}
+				if err := iter.Err(); err != nil {
+					return conf, err
+				}
+				req.Header[string(k)] = vs
 			}
-			if err := iter.Err(); err != nil {
-				return err
-			}
-			req.Header[string(k)] = vs
 		}
 	}
 	if err := iter.Err(); err != nil {
-		return err
+		return conf, err
+	}
+
+	conf.negativeCache = negative
+	if !hasNegative {
+		conf.negativeCache = conf.cache
+		if conf.negativeCache > defaultNegativeCache {
+			conf.negativeCache = defaultNegativeCache
+		}
+	}
+	return conf, nil
+}
+
+// boolean converts the atom true or false into a bool.
+func boolean(t engine.Term) (bool, error) {
+	switch t {
+	case engine.Atom("true"):
+		return true, nil
+	case engine.Atom("false"):
+		return false, nil
+	default:
+		return false, engine.DomainError("boolean", t)
 	}
-	return nil
 }
 
 var logLevels = map[engine.Atom]func(*zerolog.Logger) *zerolog.Event{
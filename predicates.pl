@@ -1,3 +1,38 @@
+% listen(Addr) is a shorthand for listen(Addr, http).
+:- dynamic(listen/1).
+:- dynamic(listen/2).
+listen(Addr, http) :-
+	listen(Addr).
+
+:- dynamic(proxy_option/2).
+:- dynamic(metrics_listen/1).
+
+% health_check(Proxy, URL, IntervalSeconds, Options) declares a health check of Proxy in the background.
+:- dynamic(health_check/4).
+
+% circuit_breaker(Failures, CooldownSeconds) skips proxies for CooldownSeconds after Failures consecutive failures.
+:- dynamic(circuit_breaker/2).
+
+% race(Options, Count, StaggerMs) races Count proxies of tunnel(Proxy, Options) at a time, starting StaggerMs apart.
+% race(Options, Count) is a shorthand for race(Options, Count, 250).
+:- dynamic(race/2).
+:- dynamic(race/3).
+race(Options, Count, 250) :-
+	race(Options, Count).
+
+% max_connections(Proxy, Max, Options) limits the number of live connections via Proxy to Max.
+% max_connections(Proxy, Max) is a shorthand for max_connections(Proxy, Max, []).
+:- dynamic(max_connections/2).
+:- dynamic(max_connections/3).
+max_connections(Proxy, Max, []) :-
+	max_connections(Proxy, Max).
+
+% exit_ip_url(URL) declares the echo service which responds with the IP address of the client for exit_ip/2.
+:- dynamic(exit_ip_url/1).
+
+% userinfo_syntax(terms) opts in to parsing the userinfo subcomponent as a list of Prolog terms.
+:- dynamic(userinfo_syntax/1).
+
 :- built_in(probe/3).
 probe(Proxy, Target, Options) :-
     probe(Proxy, Target, Options, Status),
@@ -7,6 +42,32 @@ probe(Proxy, Target, Options) :-
 probe(Proxy, Target) :-
 	probe(Proxy, Target, []).
 
+:- built_in(exit_ip/3).
+exit_ip(Proxy, IP, Options) :-
+	(exit_ip_url(URL) -> true; URL = 'https://api.ipify.org'),
+	exit_ip(Proxy, URL, Options, IP).
+
+:- built_in(exit_ip/2).
+exit_ip(Proxy, IP) :-
+	exit_ip(Proxy, IP, []).
+
+:- built_in(healthy/1).
+healthy(Proxy) :-
+	health(Proxy, healthy).
+
+:- built_in(least_connections/2).
+least_connections(Candidates, Proxy) :-
+	findall(N-P, (member(P, Candidates), connections(P, N)), Pairs),
+	keysort(Pairs, Sorted),
+	member(_-Proxy, Sorted).
+
+% fastest(Candidates, Proxy) enumerates the proxies with known handshake latencies first.
+:- built_in(fastest/2).
+fastest(Candidates, Proxy) :-
+	findall(Key-P, (member(P, Candidates), proxy_stats(P, Stats), (member(latency(L), Stats) -> Key = 0-L; Key = 1-0)), Pairs),
+	keysort(Pairs, Sorted),
+	member(_-Proxy, Sorted).
+
 :- built_in(mod/3).
 mod(N, List, Elem) :-
 	length(List, L),
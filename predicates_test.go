@@ -6,7 +6,9 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ichiban/prolog/engine"
 	"github.com/stretchr/testify/assert"
@@ -162,6 +164,175 @@ func TestProbe(t *testing.T) {
 		assert.False(t, ok)
 	})
 
+	t.Run("cache", func(t *testing.T) {
+		var calls int
+		clientDo = func(c *http.Client, req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader(nil)),
+			}, nil
+		}
+		defer func() {
+			clientDo = (*http.Client).Do
+		}()
+
+		for i := 0; i < 3; i++ {
+			ok, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/cache"), engine.List(engine.Atom("cache").Apply(engine.Integer(60))), engine.Integer(200), engine.Success, nil).Force(context.Background())
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("cache by options", func(t *testing.T) {
+		var calls int
+		clientDo = func(c *http.Client, req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("hello")),
+			}, nil
+		}
+		defer func() {
+			clientDo = (*http.Client).Do
+		}()
+
+		probe := func(opts ...engine.Term) bool {
+			opts = append(opts, engine.Atom("cache").Apply(engine.Integer(60)))
+			ok, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/cache_by_options"), engine.List(opts...), engine.Integer(200), engine.Success, nil).Force(context.Background())
+			assert.NoError(t, err)
+			return ok
+		}
+
+		for i := 0; i < 2; i++ {
+			assert.False(t, probe(engine.Atom("expect_body").Apply(engine.Atom("ok"))))
+			assert.True(t, probe())
+		}
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("cache is not a number", func(t *testing.T) {
+		_, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(engine.Atom("cache").Apply(engine.Atom("foo"))), engine.Integer(200), engine.Success, nil).Force(context.Background())
+		assert.Equal(t, engine.TypeError("number", engine.Atom("foo")), err)
+	})
+
+	t.Run("request options", func(t *testing.T) {
+		clientDo = func(c *http.Client, req *http.Request) (*http.Response, error) {
+			assert.Equal(t, 500*time.Millisecond, c.Timeout)
+			assert.True(t, c.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+			assert.Equal(t, http.ErrUseLastResponse, c.CheckRedirect(req, nil))
+			assert.Equal(t, http.MethodPost, req.Method)
+			b, err := io.ReadAll(req.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "ping", string(b))
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Body:       io.NopCloser(bytes.NewReader(nil)),
+			}, nil
+		}
+		defer func() {
+			clientDo = (*http.Client).Do
+		}()
+
+		ok, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(
+			engine.Atom("method").Apply(engine.Atom("post")),
+			engine.Atom("body").Apply(engine.Atom("ping")),
+			engine.Atom("timeout").Apply(engine.Integer(500)),
+			engine.Atom("insecure").Apply(engine.Atom("true")),
+			engine.Atom("follow_redirects").Apply(engine.Atom("false")),
+		), engine.Integer(302), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("default timeout", func(t *testing.T) {
+		clientDo = func(c *http.Client, req *http.Request) (*http.Response, error) {
+			assert.Equal(t, defaultProbeTimeout, c.Timeout)
+			assert.Nil(t, c.CheckRedirect)
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader(nil)),
+			}, nil
+		}
+		defer func() {
+			clientDo = (*http.Client).Do
+		}()
+
+		ok, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(), engine.Integer(200), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("expect body", func(t *testing.T) {
+		clientDo = func(c *http.Client, req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"status":"ok"}`)),
+			}, nil
+		}
+		defer func() {
+			clientDo = (*http.Client).Do
+		}()
+
+		ok, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(engine.Atom("expect_body").Apply(engine.Atom(`"status":"ok"`))), engine.Integer(200), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(engine.Atom("expect_body").Apply(engine.Atom(`"status":"ng"`))), engine.Integer(200), engine.Success, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("result", func(t *testing.T) {
+		clientDo = func(c *http.Client, req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/plain"}, "Via": {"a", "b"}},
+				Body:       io.NopCloser(strings.NewReader("hello, world")),
+			}, nil
+		}
+		defer func() {
+			clientDo = (*http.Client).Do
+		}()
+
+		result := engine.NewVariable()
+		ok, err := probe(nil, nil, engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(engine.Atom("max_body").Apply(engine.Integer(5))), engine.Integer(200), result, func(env *engine.Env) *engine.Promise {
+			iter := engine.ListIterator{List: result, Env: env}
+			var opts []*engine.Compound
+			for iter.Next() {
+				opts = append(opts, env.Resolve(iter.Current()).(*engine.Compound))
+			}
+			assert.NoError(t, iter.Err())
+			assert.Len(t, opts, 4)
+			assert.Equal(t, engine.Atom("status").Apply(engine.Integer(200)), opts[0])
+			assert.Equal(t, engine.Atom("latency"), opts[1].Functor)
+			assert.Equal(t, engine.Atom("headers").Apply(engine.List(
+				engine.Atom("-").Apply(engine.Atom("Content-Type"), engine.List(engine.Atom("text/plain"))),
+				engine.Atom("-").Apply(engine.Atom("Via"), engine.List(engine.Atom("a"), engine.Atom("b"))),
+			)), opts[2])
+			assert.Equal(t, engine.Atom("body").Apply(engine.Atom("hello")), opts[3])
+			return engine.Bool(true)
+		}, nil).Force(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("timeout is not an integer", func(t *testing.T) {
+		_, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(engine.Atom("timeout").Apply(engine.Atom("foo"))), engine.Integer(200), engine.Success, nil).Force(context.Background())
+		assert.Equal(t, engine.TypeErrorInteger(engine.Atom("foo")), err)
+	})
+
+	t.Run("insecure is not a boolean", func(t *testing.T) {
+		_, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(engine.Atom("insecure").Apply(engine.Atom("yes"))), engine.Integer(200), engine.Success, nil).Force(context.Background())
+		assert.Equal(t, engine.DomainError("boolean", engine.Atom("yes")), err)
+	})
+
+	t.Run("expect body is not a regex", func(t *testing.T) {
+		_, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.List(engine.Atom("expect_body").Apply(engine.Atom("("))), engine.Integer(200), engine.Success, nil).Force(context.Background())
+		assert.Equal(t, engine.DomainError("regex", engine.Atom("(")), err)
+	})
+
 	t.Run("options is not a proper list", func(t *testing.T) {
 		_, err := Probe(engine.Atom("localhost:8080"), engine.Atom("https://example.com/ok"), engine.ListRest(engine.Variable("Rest")), engine.Integer(200), engine.Success, nil).Force(context.Background())
 		assert.Equal(t, engine.ErrInstantiation, err)
@@ -0,0 +1,578 @@
+package proxima
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+)
+
+// proxy is a route to targets chosen by tunnel/2. It consists of zero or more hops.
+// If it has no hops, it's direct egress without proxies.
+type proxy struct {
+	// term is the solution of tunnel/2 the proxy is built from.
+	term engine.Term
+	name string
+	// label is the name without passwords to expose in logs, metrics, and the admin API.
+	label     string
+	hops      []*hop
+	localAddr *net.TCPAddr
+	timeouts  timeouts
+}
+
+// hop is an upstream proxy in a route.
+type hop struct {
+	name     string
+	label    string
+	url      *url.URL
+	tls      *tls.Config
+	timeouts timeouts
+}
+
+// timeouts bounds the steps of a tunnel. Zero means no timeout.
+type timeouts struct {
+	// connect bounds connecting to the first hop, or the target if it's direct egress.
+	connect time.Duration
+	// handshake bounds each hop to respond to the handshake, e.g. CONNECT.
+	handshake time.Duration
+	// idle closes the tunnel without traffic in either direction.
+	idle time.Duration
+}
+
+// timeouts returns the default timeouts.
+func (s *Switcher) timeouts() timeouts {
+	return timeouts{
+		connect:   s.ConnectTimeout,
+		handshake: s.HandshakeTimeout,
+		idle:      s.IdleTimeout,
+	}
+}
+
+// proxy builds a route from the solution of tunnel/2 and the options of each hop declared by proxy_option/2.
+// The solution is either an atom of a proxy URL, an atom direct, a compound direct(LocalAddr), or a compound chain(Proxies).
+func (s *Switcher) proxy(ctx context.Context, t engine.Term) (*proxy, error) {
+	p := proxy{
+		term:     t,
+		timeouts: s.timeouts(),
+	}
+	switch t := t.(type) {
+	case engine.Atom:
+		p.name = string(t)
+		p.label = p.name
+		if t == "direct" {
+			break
+		}
+		h, err := s.hop(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		p.label = h.label
+		p.hops = []*hop{h}
+		p.timeouts = h.timeouts
+	case *engine.Compound:
+		if len(t.Args) != 1 {
+			return nil, engine.DomainError("proxy", t)
+		}
+		switch t.Functor {
+		case "direct":
+			a, ok := t.Args[0].(engine.Atom)
+			if !ok {
+				return nil, engine.TypeErrorAtom(t.Args[0])
+			}
+			addr, err := localAddr(string(a))
+			if err != nil {
+				return nil, err
+			}
+			p.name = directName(a)
+			p.label = p.name
+			p.localAddr = addr
+		case "chain":
+			var names, labels []string
+			iter := engine.ListIterator{List: t.Args[0]}
+			for iter.Next() {
+				h, err := s.hop(ctx, iter.Current())
+				if err != nil {
+					return nil, err
+				}
+				p.hops = append(p.hops, h)
+				names = append(names, h.name)
+				labels = append(labels, h.label)
+			}
+			if err := iter.Err(); err != nil {
+				return nil, err
+			}
+			if len(p.hops) == 0 {
+				return nil, engine.DomainError("non_empty_list", t.Args[0])
+			}
+			p.name = chainName(names)
+			p.label = chainName(labels)
+			// The first hop decides how long to connect, and the last hop how long to be idle.
+			p.timeouts = p.last().timeouts
+			p.timeouts.connect = p.hops[0].timeouts.connect
+		default:
+			return nil, engine.DomainError("proxy", t)
+		}
+	default:
+		return nil, engine.DomainError("proxy", t)
+	}
+
+	return &p, nil
+}
+
+// proxyName returns the name of the proxy the solution of tunnel/2 stands for without building it. The state of the
+// proxy such as its connections, statistics, and circuit is kept by the name.
+func proxyName(t engine.Term, env *engine.Env) (string, error) {
+	switch t := env.Resolve(t).(type) {
+	case engine.Atom:
+		return string(t), nil
+	case *engine.Compound:
+		if len(t.Args) != 1 {
+			return "", engine.DomainError("proxy", t)
+		}
+		switch t.Functor {
+		case "direct":
+			a, ok := env.Resolve(t.Args[0]).(engine.Atom)
+			if !ok {
+				return "", engine.TypeErrorAtom(t.Args[0])
+			}
+			return directName(a), nil
+		case "chain":
+			var names []string
+			iter := engine.ListIterator{List: t.Args[0], Env: env}
+			for iter.Next() {
+				a, ok := env.Resolve(iter.Current()).(engine.Atom)
+				if !ok {
+					return "", engine.TypeErrorAtom(iter.Current())
+				}
+				names = append(names, string(a))
+			}
+			if err := iter.Err(); err != nil {
+				return "", err
+			}
+			return chainName(names), nil
+		default:
+			return "", engine.DomainError("proxy", t)
+		}
+	default:
+		return "", engine.DomainError("proxy", t)
+	}
+}
+
+func directName(addr engine.Atom) string {
+	return fmt.Sprintf("direct(%s)", addr)
+}
+
+func chainName(hops []string) string {
+	return fmt.Sprintf("chain([%s])", strings.Join(hops, ","))
+}
+
+// hop builds a hop from an atom of a proxy URL and its options declared by proxy_option/2.
+func (s *Switcher) hop(ctx context.Context, t engine.Term) (*hop, error) {
+	a, ok := t.(engine.Atom)
+	if !ok {
+		return nil, engine.TypeErrorAtom(t)
+	}
+
+	u, err := ParseURL(string(a))
+	if err != nil {
+		return nil, err
+	}
+
+	h := hop{
+		name:  string(a),
+		label: redact(string(a)),
+		url:   u,
+	}
+
+	o, err := s.hopOptions(ctx, h.name, u)
+	if err != nil {
+		return nil, err
+	}
+	h.tls = o.tls
+
+	h.timeouts, err = parseTimeouts(s.timeouts(), o.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+// redact returns the proxy URL with its password masked if any.
+func redact(raw string) string {
+	u, err := ParseURL(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+// parseTimeouts overrides the default timeouts with timeout(Kind, Ms) in the options where Kind is one of connect,
+// handshake, or idle. If there're multiple options of the same kind, the first one wins.
+func parseTimeouts(def timeouts, opts []engine.Term) (timeouts, error) {
+	t := def
+	set := map[engine.Atom]bool{}
+	for _, o := range opts {
+		o, ok := o.(*engine.Compound)
+		if !ok || o.Functor != "timeout" || len(o.Args) != 2 {
+			continue
+		}
+
+		kind, ok := o.Args[0].(engine.Atom)
+		if !ok {
+			return timeouts{}, engine.TypeErrorAtom(o.Args[0])
+		}
+		ms, ok := o.Args[1].(engine.Integer)
+		if !ok {
+			return timeouts{}, engine.TypeErrorInteger(o.Args[1])
+		}
+		if ms < 0 {
+			return timeouts{}, engine.DomainError("not_less_than_zero", o.Args[1])
+		}
+		if set[kind] {
+			continue
+		}
+		set[kind] = true
+
+		d := time.Duration(ms) * time.Millisecond
+		switch kind {
+		case "connect":
+			t.connect = d
+		case "handshake":
+			t.handshake = d
+		case "idle":
+			t.idle = d
+		default:
+			return timeouts{}, engine.DomainError("timeout_kind", kind)
+		}
+	}
+	return t, nil
+}
+
+// localAddr parses either host:port or host as a local TCP address.
+func localAddr(addr string) (*net.TCPAddr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	return net.ResolveTCPAddr("tcp", addr)
+}
+
+// maxHopOptions is the maximum number of hops hopOptions caches the options of.
+const maxHopOptions = 1024
+
+// hopOptions is the options of a hop declared by proxy_option/2 and the TLS config built from them.
+type hopOptions struct {
+	opts []engine.Term
+	tls  *tls.Config
+}
+
+// hopOptionsCache caches hopOptions by hop for the lifetime of a Switcher since the configuration doesn't change.
+type hopOptionsCache struct {
+	mu      sync.Mutex
+	entries map[string]*hopOptions
+}
+
+func newHopOptionsCache() *hopOptionsCache {
+	return &hopOptionsCache{
+		entries: map[string]*hopOptions{},
+	}
+}
+
+func (c *hopOptionsCache) get(name string) (*hopOptions, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o, ok := c.entries[name]
+	return o, ok
+}
+
+func (c *hopOptionsCache) put(name string, o *hopOptions) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Proxy names built from URI templates may be countless.
+	if len(c.entries) >= maxHopOptions {
+		c.entries = map[string]*hopOptions{}
+	}
+	c.entries[name] = o
+}
+
+// hopOptions returns the options of the hop named name at u. The TLS config is built only for https proxies.
+func (s *Switcher) hopOptions(ctx context.Context, name string, u *url.URL) (*hopOptions, error) {
+	if o, ok := s.hopOptionsCache.get(name); ok {
+		return o, nil
+	}
+
+	opts, err := s.proxyOptions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	o := hopOptions{opts: opts}
+	if u.Scheme == "https" {
+		o.tls, err = tlsConfig(u, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.hopOptionsCache.put(name, &o)
+	return &o, nil
+}
+
+// proxyOptions returns the options declared by proxy_option(Proxy, Option) for the proxy.
+func (s *Switcher) proxyOptions(ctx context.Context, name string) ([]engine.Term, error) {
+	sols, err := s.QueryContext(ctx, `proxy_option(?, Option).`, engine.Atom(name))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = sols.Close()
+	}()
+
+	var opts []engine.Term
+	for sols.Next() {
+		var sol struct {
+			Option engine.Term
+		}
+		if err := sols.Scan(&sol); err != nil {
+			return nil, err
+		}
+		opts = append(opts, sol.Option)
+	}
+	return opts, sols.Err()
+}
+
+// HopError is an error at a hop in a chain of proxies.
+type HopError struct {
+	Hop int
+	// Proxy is the hop without its password.
+	Proxy string
+	Err   error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("hop %d (%s): %v", e.Hop, e.Proxy, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// dial connects to the last hop through the preceding hops by nested CONNECTs.
+// If it's direct egress, it connects to target instead. It gives up once ctx is done.
+func (p *proxy) dial(ctx context.Context, target net.Addr) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout: p.timeouts.connect,
+	}
+
+	if len(p.hops) == 0 {
+		if p.localAddr != nil {
+			d.LocalAddr = p.localAddr
+		}
+		return d.DialContext(ctx, "tcp", target.String())
+	}
+
+	c, err := d.DialContext(ctx, "tcp", urlHostPort(p.hops[0].url))
+	if err != nil {
+		return nil, p.hopError(0, err)
+	}
+	// Keep what the proxies send right after their responses to CONNECT.
+	conn := net.Conn(NewBufferedConn(c, nil))
+
+	for i, h := range p.hops {
+		if i > 0 {
+			prev := p.hops[i-1]
+			if err := withDeadline(ctx, conn, prev.timeouts.handshake, func(ctx context.Context) error {
+				_, err := HandshakeContext(ctx, conn, prev.url, TargetAddr(urlHostPort(h.url)), nil)
+				return err
+			}); err != nil {
+				_ = conn.Close()
+				return nil, p.hopError(i-1, err)
+			}
+		}
+
+		if h.tls == nil {
+			continue
+		}
+
+		tc := tls.Client(conn, h.tls)
+		if err := withDeadline(ctx, conn, h.timeouts.handshake, tc.HandshakeContext); err != nil {
+			_ = conn.Close()
+			return nil, p.hopError(i, err)
+		}
+		conn = NewBufferedConn(tc, nil)
+	}
+
+	return conn, nil
+}
+
+// handshake asks the last hop connected via conn to connect to target. If it's direct egress, conn is already connected to target.
+// It gives up once ctx is done.
+func (p *proxy) handshake(ctx context.Context, conn net.Conn, target net.Addr, header http.Header) (*http.Response, error) {
+	if len(p.hops) == 0 {
+		return connectionEstablished(), nil
+	}
+	var resp *http.Response
+	if err := withDeadline(ctx, conn, p.last().timeouts.handshake, func(ctx context.Context) error {
+		var err error
+		resp, err = HandshakeContext(ctx, conn, p.last().url, target, header)
+		return err
+	}); err != nil {
+		return nil, p.hopError(len(p.hops)-1, err)
+	}
+	return resp, nil
+}
+
+// aLongTimeAgo is a deadline in the past to interrupt blocking I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// withDeadline calls f which does I/O on conn within the timeout if it's not zero. f is also given a context bounded by
+// the timeout for the work other than I/O on conn, e.g. DNS lookups. Once ctx is done, f is interrupted and ctx.Err() is
+// returned.
+func withDeadline(ctx context.Context, conn net.Conn, timeout time.Duration, f func(ctx context.Context) error) error {
+	fctx := ctx
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer func() {
+			_ = conn.SetDeadline(time.Time{})
+		}()
+
+		var cancel context.CancelFunc
+		fctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	err := f(fctx)
+	close(stop)
+	if <-interrupted {
+		_ = conn.SetDeadline(time.Time{})
+		return ctx.Err()
+	}
+	return err
+}
+
+// hopError reports which hop failed if the proxy is a chain of proxies.
+func (p *proxy) hopError(i int, err error) error {
+	if len(p.hops) < 2 {
+		return err
+	}
+	return &HopError{
+		Hop:   i,
+		Proxy: p.hops[i].label,
+		Err:   err,
+	}
+}
+
+// last returns the last hop.
+func (p *proxy) last() *hop {
+	return p.hops[len(p.hops)-1]
+}
+
+// isHTTP reports whether the last hop accepts plain HTTP requests in absolute-form.
+func (p *proxy) isHTTP() bool {
+	if len(p.hops) == 0 {
+		return false
+	}
+	u := p.last().url
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// tlsConfig builds a TLS configuration for the HTTPS proxy u from the options below:
+//
+//	ca_file(File): PEM encoded CA certificates to verify the proxy's certificate
+//	cert_file(File), key_file(File): PEM encoded client certificate and key
+//	insecure(true): skips verification of the proxy's certificate
+//	server_name(Name): overrides the server name for SNI and verification
+func tlsConfig(u *url.URL, opts []engine.Term) (*tls.Config, error) {
+	c := tls.Config{
+		ServerName: u.Hostname(),
+	}
+
+	var certFile, keyFile string
+	for _, o := range opts {
+		o, ok := o.(*engine.Compound)
+		if !ok || len(o.Args) != 1 {
+			continue
+		}
+		switch o.Functor {
+		case "ca_file":
+			f, ok := o.Args[0].(engine.Atom)
+			if !ok {
+				return nil, engine.TypeErrorAtom(o.Args[0])
+			}
+			b, err := ioutil.ReadFile(string(f))
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("no certificates found: %s", f)
+			}
+			c.RootCAs = pool
+		case "cert_file":
+			f, ok := o.Args[0].(engine.Atom)
+			if !ok {
+				return nil, engine.TypeErrorAtom(o.Args[0])
+			}
+			certFile = string(f)
+		case "key_file":
+			f, ok := o.Args[0].(engine.Atom)
+			if !ok {
+				return nil, engine.TypeErrorAtom(o.Args[0])
+			}
+			keyFile = string(f)
+		case "insecure":
+			insecure, err := boolean(o.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			c.InsecureSkipVerify = insecure
+		case "server_name":
+			n, ok := o.Args[0].(engine.Atom)
+			if !ok {
+				return nil, engine.TypeErrorAtom(o.Args[0])
+			}
+			c.ServerName = string(n)
+		}
+	}
+
+	switch {
+	case certFile != "" && keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	case certFile != "" || keyFile != "":
+		return nil, errors.New("both cert_file/1 and key_file/1 are required")
+	}
+
+	return &c, nil
+}
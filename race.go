@@ -0,0 +1,181 @@
+package proxima
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ichiban/prolog"
+	"github.com/ichiban/prolog/engine"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+// attempt is a connection to the target established via the proxy of the candidate.
+type attempt struct {
+	candidate
+	conn      net.Conn
+	resp      *http.Response
+	start     time.Time
+	handshake time.Duration
+}
+
+// connect establishes a connection to target via the proxies of tunnel/2 with opts. If race/3 succeeds with opts,
+// it races the proxies Count at a time. Otherwise, it tries them one after another. It returns nil if none succeeded.
+func (s *Switcher) connect(ctx context.Context, log *zerolog.Logger, rid xid.ID, opts engine.Term, target net.Addr, header http.Header) (*attempt, error) {
+	n, stagger, err := s.raceConfig(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var a *attempt
+	_, err = s.eachN(ctx, log, opts, n, func(cs []candidate) int {
+		var i int
+		a, i = s.race(ctx, rid, cs, target, header, stagger)
+		return i
+	})
+	return a, err
+}
+
+// raceConfig returns the number of proxies to race at a time and the interval between their starts declared by
+// race(Options, Count, StaggerMs). If it's not declared for opts, the number is 1.
+func (s *Switcher) raceConfig(ctx context.Context, opts engine.Term) (int, time.Duration, error) {
+	var sol struct {
+		Count   engine.Term
+		Stagger engine.Term
+	}
+	switch err := s.QuerySolutionContext(ctx, `race(?, Count, Stagger).`, opts).Scan(&sol); {
+	case err == nil:
+		break
+	case errors.Is(err, prolog.ErrNoSolutions):
+		return 1, 0, nil
+	default:
+		return 0, 0, err
+	}
+
+	n, ok := sol.Count.(engine.Integer)
+	if !ok {
+		return 0, 0, engine.TypeErrorInteger(sol.Count)
+	}
+	if n <= 0 {
+		return 0, 0, engine.DomainError("positive_integer", sol.Count)
+	}
+	ms, ok := sol.Stagger.(engine.Integer)
+	if !ok {
+		return 0, 0, engine.TypeErrorInteger(sol.Stagger)
+	}
+	if ms < 0 {
+		return 0, 0, engine.DomainError("not_less_than_zero", sol.Stagger)
+	}
+	return int(n), time.Duration(ms) * time.Millisecond, nil
+}
+
+// race attempts the candidates concurrently, starting each stagger after the previous one or right after the previous
+// one fails. It keeps the first connection established and aborts the rest. It returns the connection and the index
+// of its candidate, or nil and -1 if all of them failed.
+func (s *Switcher) race(ctx context.Context, rid xid.ID, cs []candidate, target net.Addr, header http.Header, stagger time.Duration) (*attempt, int) {
+	if len(cs) == 1 {
+		a := s.attempt(ctx, rid, cs[0], target, header)
+		if a == nil {
+			return nil, -1
+		}
+		return a, 0
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i int
+		a *attempt
+	}
+	results := make(chan result, len(cs))
+
+	var (
+		started int
+		next    <-chan time.Time
+	)
+	start := func() {
+		i := started
+		started++
+		go func() {
+			results <- result{i: i, a: s.attempt(ctx, rid, cs[i], target, header)}
+		}()
+		next = nil
+		if started < len(cs) {
+			next = time.After(stagger)
+		}
+	}
+
+	start()
+	for pending := 1; pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if r.a == nil {
+				if started < len(cs) {
+					start()
+					pending++
+				}
+				continue
+			}
+
+			// Abort the others and close the connections established in the meantime.
+			cancel()
+			go func(n int) {
+				for ; n > 0; n-- {
+					if r := <-results; r.a != nil {
+						_ = r.a.conn.Close()
+					}
+				}
+			}(pending)
+			r.a.log.Info().Int("racers", started).Msg("race won")
+			return r.a, r.i
+		case <-next:
+			start()
+			pending++
+		}
+	}
+	return nil, -1
+}
+
+// attempt connects to target via the proxy of the candidate. It returns nil if it failed or ctx is done.
+func (s *Switcher) attempt(ctx context.Context, rid xid.ID, c candidate, target net.Addr, header http.Header) *attempt {
+	s.Metrics.attempt(c.proxy.label)
+
+	t := time.Now()
+	conn, err := c.proxy.dial(ctx, target)
+	if err != nil {
+		if ctx.Err() != nil {
+			c.log.Debug().Err(err).Msg("attempt aborted")
+			return nil
+		}
+		c.log.Warn().Err(err).Msg("proxy.dial() failed")
+		s.failure(rid, c.proxy, FailureDial, err)
+		return nil
+	}
+
+	resp, err := c.proxy.handshake(ctx, conn, target, header)
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			c.log.Debug().Err(err).Msg("attempt aborted")
+			return nil
+		}
+		c.log.Warn().Err(err).Msg("proxy.handshake() failed")
+		s.failure(rid, c.proxy, failureReason(err), err)
+		return nil
+	}
+
+	a := attempt{
+		candidate: c,
+		conn:      conn,
+		resp:      resp,
+		start:     t,
+		handshake: time.Since(t),
+	}
+	s.stats.handshake(c.proxy.name, a.handshake)
+	return &a
+}
@@ -0,0 +1,92 @@
+package proxima
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSwitcher_RaceConfig(t *testing.T) {
+	opts := engine.List(engine.Atom("tag"))
+
+	t.Run("not declared", func(t *testing.T) {
+		n, stagger, err := newTestSwitcher(t, "").raceConfig(context.Background(), opts)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, time.Duration(0), stagger)
+	})
+
+	t.Run("per request", func(t *testing.T) {
+		s := newTestSwitcher(t, "race(Options, 3, 100) :- member(tag, Options).")
+		n, stagger, err := s.raceConfig(context.Background(), opts)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, 100*time.Millisecond, stagger)
+
+		n, _, err = s.raceConfig(context.Background(), engine.List())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("shorthand", func(t *testing.T) {
+		n, stagger, err := newTestSwitcher(t, "race(_, 2).").raceConfig(context.Background(), opts)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, 250*time.Millisecond, stagger)
+	})
+
+	t.Run("count is not positive", func(t *testing.T) {
+		_, _, err := newTestSwitcher(t, "race(_, 0).").raceConfig(context.Background(), opts)
+		assert.Equal(t, engine.DomainError("positive_integer", engine.Integer(0)), err)
+	})
+
+	t.Run("stagger is not an integer", func(t *testing.T) {
+		_, _, err := newTestSwitcher(t, "race(_, 2, foo).").raceConfig(context.Background(), opts)
+		assert.Equal(t, engine.TypeErrorInteger(engine.Atom("foo")), err)
+	})
+}
+
+func TestSwitcher_Race(t *testing.T) {
+	s, err := New(nil)
+	assert.NoError(t, err)
+	s.Metrics = NewMetrics()
+
+	candidates := func(names ...string) []candidate {
+		cs := make([]candidate, len(names))
+		for i, n := range names {
+			p, err := s.proxy(context.Background(), engine.Atom(n))
+			assert.NoError(t, err)
+			cs[i] = candidate{log: zerolog.Nop(), proxy: p}
+		}
+		return cs
+	}
+
+	t.Run("all failed", func(t *testing.T) {
+		a, i := s.race(context.Background(), xid.New(), candidates("127.0.0.1:1", "127.0.0.1:2"), TargetAddr("example.com:443"), nil, time.Hour)
+		assert.Nil(t, a)
+		assert.Equal(t, -1, i)
+	})
+
+	t.Run("stagger", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, l.Close())
+		}()
+
+		// The second one starts once the first one fails even before the stagger.
+		var cs []candidate
+		cs = append(cs, candidates("127.0.0.1:1")...)
+		cs = append(cs, candidate{log: zerolog.Nop(), proxy: &proxy{name: "direct"}})
+		a, i := s.race(context.Background(), xid.New(), cs, TargetAddr(l.Addr().String()), nil, time.Hour)
+		assert.NotNil(t, a)
+		assert.Equal(t, 1, i)
+		assert.NoError(t, a.conn.Close())
+	})
+}
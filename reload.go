@@ -0,0 +1,225 @@
+package proxima
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Listener is an address to listen on and the protocol it speaks, which is declared by listen/2.
+type Listener struct {
+	Addr     string
+	Protocol string
+}
+
+// Listeners returns the listeners declared by listen/2.
+func (s *Switcher) Listeners(ctx context.Context) ([]Listener, error) {
+	sols, err := s.QueryContext(ctx, `listen(Addr, Protocol).`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = sols.Close()
+	}()
+
+	var ls []Listener
+	for sols.Next() {
+		var l Listener
+		if err := sols.Scan(&l); err != nil {
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, sols.Err()
+}
+
+var errNoListeners = errors.New("no listeners")
+
+// Reloader serves requests with the Switcher most recently loaded from the configuration files.
+// Requests in progress keep being served by the Switcher they started with.
+type Reloader struct {
+	files   []string
+	current atomic.Value
+
+	mu     sync.Mutex
+	stamps []fileStamp
+	// texts is the contents of the files as of the last reload. Changes at runtime are applied to them so that edits
+	// to the files take effect only on reload.
+	texts   []string
+	overlay overlay
+	persist string
+}
+
+// NewReloader loads a Switcher from the configuration files.
+func NewReloader(ctx context.Context, files []string) (*Reloader, error) {
+	r := Reloader{files: files}
+	if err := r.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Switcher returns the current Switcher.
+func (r *Reloader) Switcher() *Switcher {
+	return r.current.Load().(*Switcher)
+}
+
+// Reload loads a new Switcher from the configuration files and swaps it in for new requests.
+// The settings made in Go to the current one such as Authenticate are carried over.
+// If the new one fails to load or doesn't declare any listeners, it keeps the current one and returns the error.
+func (r *Reloader) Reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamps, err := stat(r.files)
+	if err != nil {
+		return err
+	}
+	texts, err := readFiles(r.files)
+	if err != nil {
+		return err
+	}
+
+	s, err := r.load(ctx, texts, r.overlay)
+	if err != nil {
+		return err
+	}
+
+	r.current.Store(s)
+	r.stamps = stamps
+	r.texts = texts
+	return nil
+}
+
+// load loads a new Switcher from the texts of the configuration files with the changes made at runtime.
+func (r *Reloader) load(ctx context.Context, texts []string, o overlay) (*Switcher, error) {
+	s, err := newSwitcher(texts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(o) > 0 {
+		var b strings.Builder
+		if err := o.write(s, &b, true); err != nil {
+			return nil, err
+		}
+		if err := s.ExecContext(ctx, b.String()); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.configure(); err != nil {
+		return nil, err
+	}
+	if prev, ok := r.current.Load().(*Switcher); ok {
+		s.inherit(prev)
+	}
+
+	ls, err := s.Listeners(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(ls) == 0 {
+		return nil, errNoListeners
+	}
+
+	return s, nil
+}
+
+// Watch polls the configuration files every interval and reloads them on change until ctx is done.
+// The result of every reload attempt is reported to f.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, f func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			stamps, err := stat(r.files)
+			if err != nil {
+				f(err)
+				continue
+			}
+
+			r.mu.Lock()
+			changed := !sameStamps(stamps, r.stamps)
+			r.mu.Unlock()
+			if !changed {
+				continue
+			}
+
+			err = r.Reload(ctx)
+			if err != nil {
+				// Don't retry until the files change again.
+				r.mu.Lock()
+				r.stamps = stamps
+				r.mu.Unlock()
+			}
+			f(err)
+		}
+	}
+}
+
+// inherit carries over the settings made in Go from the previous Switcher. It also shares the state of proxies and
+// tunnels, e.g. metrics, live tunnels, exit IPs, circuits, and statistics, so that it survives reloads. The types of the
+// shared state are no-op on nil so that a Switcher works without them.
+func (s *Switcher) inherit(prev *Switcher) {
+	s.Authenticate = prev.Authenticate
+	s.IdleTimeout = prev.IdleTimeout
+	s.ConnectTimeout = prev.ConnectTimeout
+	s.HandshakeTimeout = prev.HandshakeTimeout
+	s.TunnelFinished = prev.TunnelFinished
+	s.Metrics = prev.Metrics
+	s.Admin = prev.Admin
+	s.Health = prev.Health
+	s.probes = prev.probes
+	s.exits = prev.exits
+	s.circuits = prev.circuits
+	s.conns = prev.conns
+	s.stats = prev.stats
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Switcher().ServeHTTP(w, req)
+}
+
+// ServeSOCKS5 accepts connections on l and serves them as a SOCKS5 server with the current Switcher until l is closed.
+func (r *Reloader) ServeSOCKS5(ctx context.Context, l net.Listener) error {
+	return acceptLoop(ctx, l, func(conn net.Conn) {
+		r.Switcher().serveSOCKS5(ctx, conn)
+	})
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func stat(files []string) ([]fileStamp, error) {
+	stamps := make([]fileStamp, len(files))
+	for i, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{size: fi.Size(), modTime: fi.ModTime()}
+	}
+	return stamps, nil
+}
+
+func sameStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].size != b[i].size || !a[i].modTime.Equal(b[i].modTime) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package proxima
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloader_Reload(t *testing.T) {
+	f := writeConfig(t, `listen(':8080').`)
+
+	r, err := NewReloader(context.Background(), []string{f})
+	assert.NoError(t, err)
+	s := r.Switcher()
+
+	t.Run("ok", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(f, []byte(`listen(':8081').`), 0600))
+		assert.NoError(t, r.Reload(context.Background()))
+		assert.NotEqual(t, s, r.Switcher())
+
+		ls, err := r.Switcher().Listeners(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []Listener{{Addr: ":8081", Protocol: "http"}}, ls)
+		s = r.Switcher()
+	})
+
+	t.Run("authenticate is carried over", func(t *testing.T) {
+		s.Authenticate = func(context.Context, string, string) (bool, error) {
+			return true, nil
+		}
+		assert.NoError(t, r.Reload(context.Background()))
+		assert.NotNil(t, r.Switcher().Authenticate)
+		s = r.Switcher()
+	})
+
+	t.Run("admin is carried over", func(t *testing.T) {
+		a := NewAdmin("secret")
+		s.Admin = a
+		assert.NoError(t, r.Reload(context.Background()))
+		assert.Same(t, a, r.Switcher().Admin)
+		s = r.Switcher()
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(f, []byte(`listen(':8082'`), 0600))
+		assert.Error(t, r.Reload(context.Background()))
+		assert.Equal(t, s, r.Switcher())
+	})
+
+	t.Run("no listeners", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(f, []byte(`tunnel(direct, _).`), 0600))
+		assert.Equal(t, errNoListeners, r.Reload(context.Background()))
+		assert.Equal(t, s, r.Switcher())
+	})
+
+	t.Run("file doesn't exist", func(t *testing.T) {
+		assert.NoError(t, os.Remove(f))
+		assert.Error(t, r.Reload(context.Background()))
+		assert.Equal(t, s, r.Switcher())
+	})
+}
+
+func TestReloader_Watch(t *testing.T) {
+	f := writeConfig(t, `listen(':8080').`)
+
+	r, err := NewReloader(context.Background(), []string{f})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloaded := make(chan error)
+	go r.Watch(ctx, 10*time.Millisecond, func(err error) {
+		reloaded <- err
+	})
+
+	assert.NoError(t, os.WriteFile(f, []byte(`listen(':8081'). % changed`), 0600))
+	assert.NoError(t, <-reloaded)
+
+	ls, err := r.Switcher().Listeners(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Listener{{Addr: ":8081", Protocol: "http"}}, ls)
+}
@@ -0,0 +1,448 @@
+package proxima
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 constants described in RFC1928 and RFC1929.
+const (
+	socks5Version = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksPasswordVersion = 0x01
+	socksPasswordSuccess = 0x00
+	socksPasswordFailure = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded               = 0x00
+	socksReplyGeneralFailure          = 0x01
+	socksReplyHostUnreachable         = 0x04
+	socksReplyCommandNotSupported     = 0x07
+	socksReplyAddressTypeNotSupported = 0x08
+)
+
+var (
+	errSOCKSVersion            = errors.New("unsupported SOCKS version")
+	errSOCKSNoAcceptableMethod = errors.New("no acceptable SOCKS authentication methods")
+	errSOCKSCommand            = errors.New("unsupported SOCKS command")
+	errSOCKSAddressType        = errors.New("unsupported SOCKS address type")
+	errSOCKSAuthentication     = errors.New("SOCKS authentication failed")
+)
+
+// socks5Request is a SOCKS5 CONNECT request from a client.
+type socks5Request struct {
+	User     string
+	Password string
+	Target   string
+}
+
+// defaultSOCKS5Negotiation is how long SOCKS5 clients can take to send the request unless HandshakeTimeout is set.
+const defaultSOCKS5Negotiation = 10 * time.Second
+
+// readSOCKS5Request negotiates an authentication method with the client and reads a CONNECT request.
+// It accepts username/password authentication if offered, or no authentication otherwise.
+// If auth is not nil, it requires username/password authentication and checks the credentials with auth.
+// On unsupported requests, it replies to the client with an appropriate error before returning.
+func readSOCKS5Request(rw io.ReadWriter, auth func(user, password string) (bool, error)) (*socks5Request, error) {
+	var req socks5Request
+
+	// Method selection.
+	var head [2]byte
+	if _, err := io.ReadFull(rw, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != socks5Version {
+		return nil, errSOCKSVersion
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		switch m {
+		case socksAuthPassword:
+			method = m
+		case socksAuthNone:
+			if method == socksAuthNoAcceptable && auth == nil {
+				method = m
+			}
+		}
+	}
+	if _, err := rw.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case socksAuthNoAcceptable:
+		return nil, errSOCKSNoAcceptableMethod
+	case socksAuthPassword:
+		user, password, err := readSOCKSPassword(rw)
+		if err != nil {
+			return nil, err
+		}
+		req.User, req.Password = user, password
+		if auth != nil {
+			ok, err := auth(user, password)
+			if err != nil || !ok {
+				_, _ = rw.Write([]byte{socksPasswordVersion, socksPasswordFailure})
+				if err == nil {
+					err = errSOCKSAuthentication
+				}
+				return nil, err
+			}
+		}
+		if _, err := rw.Write([]byte{socksPasswordVersion, socksPasswordSuccess}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Request.
+	var h [4]byte
+	if _, err := io.ReadFull(rw, h[:]); err != nil {
+		return nil, err
+	}
+	if h[0] != socks5Version {
+		return nil, errSOCKSVersion
+	}
+	if h[1] != socksCmdConnect {
+		_ = writeSOCKS5Reply(rw, socksReplyCommandNotSupported, nil)
+		return nil, errSOCKSCommand
+	}
+
+	var host string
+	switch h[3] {
+	case socksAtypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksAtypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(rw, l[:]); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(rw, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		_ = writeSOCKS5Reply(rw, socksReplyAddressTypeNotSupported, nil)
+		return nil, errSOCKSAddressType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(rw, port[:]); err != nil {
+		return nil, err
+	}
+	req.Target = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	return &req, nil
+}
+
+// readSOCKSPassword reads a username/password authentication request described in RFC1929.
+func readSOCKSPassword(r io.Reader) (string, string, error) {
+	var ver [1]byte
+	if _, err := io.ReadFull(r, ver[:]); err != nil {
+		return "", "", err
+	}
+	if ver[0] != socksPasswordVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS username/password version: %d", ver[0])
+	}
+
+	var fields [2]string
+	for i := range fields {
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", "", err
+		}
+		b := make([]byte, l[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(b)
+	}
+	return fields[0], fields[1], nil
+}
+
+// writeSOCKS5Reply writes a reply with the bound address addr. If addr is not a TCP address, it's reported as 0.0.0.0:0.
+func writeSOCKS5Reply(w io.Writer, rep byte, addr net.Addr) error {
+	b := []byte{socks5Version, rep, 0x00}
+
+	ip, port := net.IPv4zero.To4(), 0
+	if a, ok := addr.(*net.TCPAddr); ok {
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+
+	_, err := w.Write(b)
+	return err
+}
+
+// socks5Connect asks the SOCKS5 server connected via rw to connect to target.
+// If resolve is true, target is resolved locally within ctx and sent as an IP address. Otherwise, it's sent as a domain
+// name.
+func socks5Connect(ctx context.Context, rw io.ReadWriter, user *url.Userinfo, target net.Addr, resolve bool) error {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	if _, err := rw.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var sel [2]byte
+	if _, err := io.ReadFull(rw, sel[:]); err != nil {
+		return err
+	}
+	if sel[0] != socks5Version {
+		return errSOCKSVersion
+	}
+	switch sel[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errSOCKSNoAcceptableMethod
+		}
+		if err := writeSOCKSPassword(rw, user); err != nil {
+			return err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(rw, status[:]); err != nil {
+			return err
+		}
+		if status[1] != socksPasswordSuccess {
+			return errors.New("SOCKS username/password authentication failed")
+		}
+	default:
+		return errSOCKSNoAcceptableMethod
+	}
+
+	host, port, err := splitHostPort(target.String())
+	if err != nil {
+		return err
+	}
+	if resolve {
+		as, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		host = as[0].IP.String()
+	}
+
+	b := []byte{socks5Version, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("domain name too long: %s", host)
+		}
+		b = append(b, socksAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	if _, err := rw.Write(b); err != nil {
+		return err
+	}
+
+	var rep [4]byte
+	if _, err := io.ReadFull(rw, rep[:]); err != nil {
+		return err
+	}
+	if rep[0] != socks5Version {
+		return errSOCKSVersion
+	}
+	var l int
+	switch rep[3] {
+	case socksAtypIPv4:
+		l = net.IPv4len
+	case socksAtypIPv6:
+		l = net.IPv6len
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(rw, n[:]); err != nil {
+			return err
+		}
+		l = int(n[0])
+	default:
+		return errSOCKSAddressType
+	}
+	if _, err := io.ReadFull(rw, make([]byte, l+2)); err != nil {
+		return err
+	}
+	if rep[1] != socksReplySucceeded {
+		return socks5ReplyError(rep[1])
+	}
+	return nil
+}
+
+// writeSOCKSPassword writes a username/password authentication request described in RFC1929.
+func writeSOCKSPassword(w io.Writer, user *url.Userinfo) error {
+	name := user.Username()
+	password, _ := user.Password()
+	if len(name) > 255 || len(password) > 255 {
+		return errors.New("SOCKS username/password too long")
+	}
+	b := []byte{socksPasswordVersion, byte(len(name))}
+	b = append(b, name...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+	_, err := w.Write(b)
+	return err
+}
+
+// socks5ReplyError is a non-successful reply from a SOCKS5 server.
+type socks5ReplyError byte
+
+func (e socks5ReplyError) Error() string {
+	switch e {
+	case 0x01:
+		return "SOCKS5 general failure"
+	case 0x02:
+		return "SOCKS5 connection not allowed by ruleset"
+	case 0x03:
+		return "SOCKS5 network unreachable"
+	case 0x04:
+		return "SOCKS5 host unreachable"
+	case 0x05:
+		return "SOCKS5 connection refused"
+	case 0x06:
+		return "SOCKS5 TTL expired"
+	case 0x07:
+		return "SOCKS5 command not supported"
+	case 0x08:
+		return "SOCKS5 address type not supported"
+	default:
+		return fmt.Sprintf("SOCKS5 unknown reply: %d", byte(e))
+	}
+}
+
+// SOCKS4a constants.
+// See https://www.openssh.com/txt/socks4.protocol and https://www.openssh.com/txt/socks4a.protocol
+const (
+	socks4Version       = 0x04
+	socks4ReplyVersion  = 0x00
+	socks4ReplyGranted  = 0x5a
+	socks4CmdConnect    = 0x01
+	socks4UnknownIPByte = 0x01
+)
+
+// socks4aConnect asks the SOCKS4a server connected via rw to connect to target.
+func socks4aConnect(rw io.ReadWriter, user *url.Userinfo, target net.Addr) error {
+	host, port, err := splitHostPort(target.String())
+	if err != nil {
+		return err
+	}
+
+	b := []byte{socks4Version, socks4CmdConnect, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		// 0.0.0.x where x is non-zero indicates the domain name follows.
+		b = append(b, 0, 0, 0, socks4UnknownIPByte)
+	} else {
+		b = append(b, ip...)
+	}
+	if user != nil {
+		b = append(b, user.Username()...)
+	}
+	b = append(b, 0x00)
+	if ip == nil {
+		b = append(b, host...)
+		b = append(b, 0x00)
+	}
+	if _, err := rw.Write(b); err != nil {
+		return err
+	}
+
+	var rep [8]byte
+	if _, err := io.ReadFull(rw, rep[:]); err != nil {
+		return err
+	}
+	if rep[0] != socks4ReplyVersion {
+		return fmt.Errorf("unsupported SOCKS4 reply version: %d", rep[0])
+	}
+	if rep[1] != socks4ReplyGranted {
+		return fmt.Errorf("SOCKS4 request rejected: %d", rep[1])
+	}
+	return nil
+}
+
+// watchClose returns a context which is canceled once the client closes conn while the server isn't reading from it.
+// stop ends watching and returns conn to read from afterwards, which keeps the data the client sent meanwhile.
+func watchClose(ctx context.Context, conn net.Conn) (context.Context, context.CancelFunc, func() net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	br := bufio.NewReader(conn)
+	stopping := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := br.Peek(1); err != nil {
+			select {
+			case <-stopping:
+			default:
+				cancel()
+			}
+		}
+	}()
+	stop := func() net.Conn {
+		close(stopping)
+		// Interrupt Peek().
+		_ = conn.SetReadDeadline(aLongTimeAgo)
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+		// The buffer is empty if Peek() failed, and its error shouldn't be read again.
+		if br.Buffered() == 0 {
+			return conn
+		}
+		return NewBufferedConn(conn, br)
+	}
+	return ctx, cancel, stop
+}
+
+func splitHostPort(hostPort string) (string, int, error) {
+	host, p, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port: %s", p)
+	}
+	return host, int(port), nil
+}
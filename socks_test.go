@@ -0,0 +1,499 @@
+package proxima
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSOCKS5Request(t *testing.T) {
+	t.Run("no authentication", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, c.Close())
+			}()
+
+			_, err := c.Write([]byte{0x05, 0x01, 0x00})
+			assert.NoError(t, err)
+
+			var b [2]byte
+			_, err = io.ReadFull(c, b[:])
+			assert.NoError(t, err)
+			assert.Equal(t, [2]byte{0x05, 0x00}, b)
+
+			_, err = c.Write([]byte{0x05, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1f, 0x90})
+			assert.NoError(t, err)
+		}()
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		req, err := readSOCKS5Request(s, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, &socks5Request{Target: "192.168.0.1:8080"}, req)
+	})
+
+	t.Run("username/password authentication", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, c.Close())
+			}()
+
+			_, err := c.Write([]byte{0x05, 0x02, 0x00, 0x02})
+			assert.NoError(t, err)
+
+			var b [2]byte
+			_, err = io.ReadFull(c, b[:])
+			assert.NoError(t, err)
+			assert.Equal(t, [2]byte{0x05, 0x02}, b)
+
+			_, err = c.Write([]byte{0x01, 0x03, 'o', 'n', 'e', 0x03, 'b', 'a', 'r'})
+			assert.NoError(t, err)
+
+			_, err = io.ReadFull(c, b[:])
+			assert.NoError(t, err)
+			assert.Equal(t, [2]byte{0x01, 0x00}, b)
+
+			_, err = c.Write([]byte{0x05, 0x01, 0x00, 0x03, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x01, 0xbb})
+			assert.NoError(t, err)
+		}()
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		req, err := readSOCKS5Request(s, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, &socks5Request{User: "one", Password: "bar", Target: "example.com:443"}, req)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, c.Close())
+			}()
+
+			_, err := c.Write([]byte{0x04, 0x01})
+			assert.NoError(t, err)
+		}()
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		_, err := readSOCKS5Request(s, nil)
+		assert.Equal(t, errSOCKSVersion, err)
+	})
+
+	t.Run("no acceptable methods", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, c.Close())
+			}()
+
+			_, err := c.Write([]byte{0x05, 0x01, 0x01})
+			assert.NoError(t, err)
+
+			var b [2]byte
+			_, err = io.ReadFull(c, b[:])
+			assert.NoError(t, err)
+			assert.Equal(t, [2]byte{0x05, 0xff}, b)
+		}()
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		_, err := readSOCKS5Request(s, nil)
+		assert.Equal(t, errSOCKSNoAcceptableMethod, err)
+	})
+
+	auth := func(user, password string) (bool, error) {
+		return user == "one" && password == "bar", nil
+	}
+
+	t.Run("authentication required", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, c.Close())
+			}()
+
+			_, err := c.Write([]byte{0x05, 0x01, 0x00})
+			assert.NoError(t, err)
+
+			var b [2]byte
+			_, err = io.ReadFull(c, b[:])
+			assert.NoError(t, err)
+			assert.Equal(t, [2]byte{0x05, 0xff}, b)
+		}()
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		_, err := readSOCKS5Request(s, auth)
+		assert.Equal(t, errSOCKSNoAcceptableMethod, err)
+	})
+
+	t.Run("authentication failed", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, c.Close())
+			}()
+
+			_, err := c.Write([]byte{0x05, 0x02, 0x00, 0x02})
+			assert.NoError(t, err)
+
+			var b [2]byte
+			_, err = io.ReadFull(c, b[:])
+			assert.NoError(t, err)
+			assert.Equal(t, [2]byte{0x05, 0x02}, b)
+
+			_, err = c.Write([]byte{0x01, 0x03, 'o', 'n', 'e', 0x03, 'b', 'a', 'z'})
+			assert.NoError(t, err)
+
+			_, err = io.ReadFull(c, b[:])
+			assert.NoError(t, err)
+			assert.Equal(t, [2]byte{0x01, 0x01}, b)
+		}()
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		_, err := readSOCKS5Request(s, auth)
+		assert.Equal(t, errSOCKSAuthentication, err)
+	})
+
+	t.Run("unsupported command", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, c.Close())
+			}()
+
+			_, err := c.Write([]byte{0x05, 0x01, 0x00})
+			assert.NoError(t, err)
+
+			var b [2]byte
+			_, err = io.ReadFull(c, b[:])
+			assert.NoError(t, err)
+
+			_, err = c.Write([]byte{0x05, 0x02, 0x00, 0x01})
+			assert.NoError(t, err)
+
+			var rep [10]byte
+			_, err = io.ReadFull(c, rep[:])
+			assert.NoError(t, err)
+			assert.Equal(t, byte(0x07), rep[1])
+		}()
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+
+		_, err := readSOCKS5Request(s, nil)
+		assert.Equal(t, errSOCKSCommand, err)
+	})
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	t.Run("username/password authentication", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, s.Close())
+			}()
+
+			req, err := readSOCKS5Request(s, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, &socks5Request{User: "foo", Password: "bar", Target: "example.com:443"}, req)
+
+			assert.NoError(t, writeSOCKS5Reply(s, socksReplySucceeded, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}))
+		}()
+		defer func() {
+			assert.NoError(t, c.Close())
+		}()
+
+		assert.NoError(t, socks5Connect(context.Background(), c, url.UserPassword("foo", "bar"), TargetAddr("example.com:443"), false))
+	})
+
+	t.Run("resolve locally", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, s.Close())
+			}()
+
+			req, err := readSOCKS5Request(s, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, &socks5Request{Target: "127.0.0.1:443"}, req)
+
+			assert.NoError(t, writeSOCKS5Reply(s, socksReplySucceeded, nil))
+		}()
+		defer func() {
+			assert.NoError(t, c.Close())
+		}()
+
+		assert.NoError(t, socks5Connect(context.Background(), c, nil, TargetAddr("127.0.0.1:443"), true))
+	})
+
+	t.Run("resolve locally canceled", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, s.Close())
+			}()
+
+			_, err := io.ReadFull(s, make([]byte, 3))
+			assert.NoError(t, err)
+			_, err = s.Write([]byte{0x05, 0x00})
+			assert.NoError(t, err)
+		}()
+		defer func() {
+			assert.NoError(t, c.Close())
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := socks5Connect(ctx, c, nil, TargetAddr("example.com:443"), true)
+		assert.True(t, errors.Is(err, context.Canceled))
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, s.Close())
+			}()
+
+			_, err := readSOCKS5Request(s, nil)
+			assert.NoError(t, err)
+
+			assert.NoError(t, writeSOCKS5Reply(s, 0x05, nil))
+		}()
+		defer func() {
+			assert.NoError(t, c.Close())
+		}()
+
+		assert.Equal(t, socks5ReplyError(0x05), socks5Connect(context.Background(), c, nil, TargetAddr("example.com:443"), false))
+	})
+}
+
+func TestSOCKS4aConnect(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, s.Close())
+			}()
+
+			b := make([]byte, 8+len("foo")+1+len("example.com")+1)
+			_, err := io.ReadFull(s, b)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("\x04\x01\x01\xbb\x00\x00\x00\x01foo\x00example.com\x00"), b)
+
+			_, err = s.Write([]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0})
+			assert.NoError(t, err)
+		}()
+		defer func() {
+			assert.NoError(t, c.Close())
+		}()
+
+		assert.NoError(t, socks4aConnect(c, url.User("foo"), TargetAddr("example.com:443")))
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		s, c := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, s.Close())
+			}()
+
+			b := make([]byte, 9)
+			_, err := io.ReadFull(s, b)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("\x04\x01\x01\xbb\xc0\xa8\x00\x01\x00"), b)
+
+			_, err = s.Write([]byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0})
+			assert.NoError(t, err)
+		}()
+		defer func() {
+			assert.NoError(t, c.Close())
+		}()
+
+		assert.Error(t, socks4aConnect(c, nil, TargetAddr("192.168.0.1:443")))
+	})
+}
+
+func TestSwitcher_ServeSOCKS5_Silent(t *testing.T) {
+	s, err := New(nil)
+	assert.NoError(t, err)
+	s.HandshakeTimeout = 50 * time.Millisecond
+
+	client, server := net.Pipe()
+	defer func() {
+		assert.NoError(t, client.Close())
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		s.serveSOCKS5(context.Background(), server)
+		close(done)
+	}()
+
+	// The client connects and sends nothing.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the silent client is kept")
+	}
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// flakyListener fails with errs before accepting conns, and then fails as closed.
+type flakyListener struct {
+	net.Listener
+	errs  []error
+	conns []net.Conn
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	if len(l.conns) > 0 {
+		conn := l.conns[0]
+		l.conns = l.conns[1:]
+		return conn, nil
+	}
+	return nil, net.ErrClosed
+}
+
+func TestAcceptLoop(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	client, server := net.Pipe()
+	defer func() {
+		assert.NoError(t, client.Close())
+	}()
+
+	l := flakyListener{errs: []error{emfile, emfile}, conns: []net.Conn{server}}
+	served := make(chan net.Conn, 1)
+	err := acceptLoop(context.Background(), &l, func(conn net.Conn) {
+		served <- conn
+	})
+	assert.True(t, errors.Is(err, net.ErrClosed))
+	assert.Equal(t, server, <-served)
+}
+
+func TestWatchClose(t *testing.T) {
+	t.Run("closed", func(t *testing.T) {
+		client, server := net.Pipe()
+		ctx, cancel, stop := watchClose(context.Background(), server)
+		defer cancel()
+
+		assert.NoError(t, client.Close())
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("not canceled")
+		}
+		assert.NoError(t, stop().Close())
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer func() {
+			assert.NoError(t, client.Close())
+		}()
+		ctx, cancel, stop := watchClose(context.Background(), server)
+		defer cancel()
+
+		conn := stop()
+		assert.NoError(t, ctx.Err())
+
+		go func() {
+			_, _ = client.Write([]byte("hello"))
+		}()
+		b := make([]byte, 5)
+		_, err := io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("data meanwhile", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer func() {
+			assert.NoError(t, client.Close())
+		}()
+		ctx, cancel, stop := watchClose(context.Background(), server)
+		defer cancel()
+
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+
+		conn := stop()
+		assert.NoError(t, ctx.Err())
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+}
+
+func TestSwitcher_ServeSOCKS5_ClientGone(t *testing.T) {
+	// The proxy accepts connections and never responds.
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, proxy.Close())
+	}()
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			defer func() {
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	s := newTestSwitcher(t, fmt.Sprintf("tunnel('http://%s', _).\n", proxy.Addr()))
+	s.HandshakeTimeout = time.Hour
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.serveSOCKS5(context.Background(), server)
+		close(done)
+	}()
+
+	// No authentication, and CONNECT example.com:80.
+	_, err = client.Write([]byte{0x05, 0x01, 0x00})
+	assert.NoError(t, err)
+	_, err = io.ReadFull(client, make([]byte, 2))
+	assert.NoError(t, err)
+	_, err = client.Write(append([]byte{0x05, 0x01, 0x00, 0x03, 11}, append([]byte("example.com"), 0x00, 80)...))
+	assert.NoError(t, err)
+	assert.NoError(t, client.Close())
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake outlives the client")
+	}
+}
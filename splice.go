@@ -0,0 +1,237 @@
+package proxima
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons why connections are closed.
+const (
+	ReasonEOF    = "eof"    // both directions finished
+	ReasonIdle   = "idle"   // neither direction transferred data for the idle timeout
+	ReasonError  = "error"  // either direction failed
+	ReasonKilled = "killed" // closed on request, e.g. by the admin API
+)
+
+var errIdle = errors.New("idle timeout")
+
+// SpliceStats is the result of splicing two connections.
+type SpliceStats struct {
+	// ToInbound is the number of bytes copied from outbound to inbound.
+	ToInbound int64
+	// ToOutbound is the number of bytes copied from inbound to outbound.
+	ToOutbound int64
+	// Reason is why the connections are closed.
+	Reason string
+}
+
+// Splice copies data between inbound and outbound in both directions until both directions finish.
+func Splice(inbound, outbound io.ReadWriteCloser) SpliceStats {
+	return SpliceIdle(inbound, outbound, 0)
+}
+
+// SpliceIdle copies data between inbound and outbound in both directions until both directions finish or neither
+// direction transfers data for idle. If idle is zero, it never times out.
+//
+// When one direction finishes, it closes the other end for writing if it supports CloseWrite so that half-closing
+// protocols keep working. Otherwise, it closes both ends.
+// Once both directions finish, it closes both ends.
+//
+// If both ends are *net.TCPConn, data is copied by (*net.TCPConn).ReadFrom which uses splice(2) on Linux.
+func SpliceIdle(inbound, outbound io.ReadWriteCloser, idle time.Duration) SpliceStats {
+	return newSplice(inbound, outbound, idle, 0).wait()
+}
+
+// newSplice returns a splice of inbound and outbound. If interval is positive, the number of bytes copied is updated
+// at least every interval so that progress() reports tunnels in progress.
+func newSplice(inbound, outbound io.ReadWriteCloser, idle, interval time.Duration) *splice {
+	now := time.Now().UnixNano()
+	return &splice{
+		conns:    [2]io.ReadWriteCloser{inbound, outbound},
+		idle:     idle,
+		interval: interval,
+		active:   [2]int64{now, now},
+	}
+}
+
+// wait copies data in both directions until both directions finish and closes both ends.
+func (s *splice) wait() SpliceStats {
+	var wg sync.WaitGroup
+	for i := range s.conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.run(i)
+		}(i)
+	}
+	wg.Wait()
+
+	s.close()
+
+	toInbound, toOutbound := s.progress()
+	stats := SpliceStats{
+		ToInbound:  toInbound,
+		ToOutbound: toOutbound,
+		Reason:     s.reason,
+	}
+	if stats.Reason == "" {
+		stats.Reason = ReasonEOF
+	}
+	return stats
+}
+
+// progress returns the number of bytes copied so far.
+func (s *splice) progress() (toInbound, toOutbound int64) {
+	return atomic.LoadInt64(&s.written[0]), atomic.LoadInt64(&s.written[1])
+}
+
+type splice struct {
+	conns    [2]io.ReadWriteCloser
+	idle     time.Duration
+	interval time.Duration
+	// idles tells whether the last window of each direction transferred no data.
+	idles [2]int32
+	// active is the last time in Unix nanoseconds when each direction transferred data.
+	active  [2]int64
+	written [2]int64
+
+	mu     sync.Mutex
+	closed bool
+	reason string
+}
+
+// run copies data from conns[i] to the other end.
+func (s *splice) run(i int) {
+	src, dst := s.conns[i], s.conns[1-i]
+	err := s.copy(i, dst, src)
+	// A finished direction never transfers data again.
+	atomic.StoreInt32(&s.idles[i], 1)
+	atomic.StoreInt64(&s.active[i], 0)
+
+	s.mu.Lock()
+	switch {
+	case s.closed:
+		// Errors caused by closing both ends don't count.
+	case errors.Is(err, errIdle):
+		s.reason = ReasonIdle
+	case err != nil:
+		s.reason = ReasonError
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.close()
+		return
+	}
+	if err := closeWrite(dst); err != nil {
+		s.close()
+	}
+}
+
+// copy copies data from src to dst until EOF. With idle timeout, it reports errIdle if neither direction transfers
+// data for idle. With idle timeout or interval, it copies in windows of read deadlines to update the progress.
+func (s *splice) copy(i int, dst io.Writer, src io.Reader) error {
+	written := &s.written[1-i]
+
+	// Data read ahead into the buffer goes first so that we can read from the underlying connection afterwards.
+	if c, ok := src.(*BufferedConn); ok {
+		if n := c.r.Buffered(); n > 0 {
+			n, err := io.CopyN(dst, c.r, int64(n))
+			atomic.AddInt64(written, n)
+			if err != nil {
+				return err
+			}
+		}
+		src = c.Conn
+	}
+	if c, ok := dst.(*BufferedConn); ok {
+		dst = c.Conn
+	}
+
+	d, ok := src.(interface {
+		SetReadDeadline(time.Time) error
+	})
+	window := s.idle
+	if s.interval > 0 && (window <= 0 || s.interval < window) {
+		window = s.interval
+	}
+	if window <= 0 || !ok {
+		n, err := io.Copy(dst, src)
+		atomic.AddInt64(written, n)
+		return err
+	}
+
+	for {
+		if err := d.SetReadDeadline(time.Now().Add(window)); err != nil {
+			return err
+		}
+		n, err := io.Copy(dst, src)
+		atomic.AddInt64(written, n)
+		switch {
+		case err == nil:
+			return nil
+		case !errors.Is(err, os.ErrDeadlineExceeded):
+			return err
+		case n > 0:
+			atomic.StoreInt32(&s.idles[i], 0)
+			atomic.StoreInt64(&s.active[i], time.Now().UnixNano())
+		default:
+			atomic.StoreInt32(&s.idles[i], 1)
+			if s.idle > 0 && s.idled(i) && s.idled(1-i) {
+				return errIdle
+			}
+		}
+	}
+}
+
+// idled reports whether the direction from conns[i] has transferred no data for the idle timeout.
+func (s *splice) idled(i int) bool {
+	if atomic.LoadInt32(&s.idles[i]) == 0 {
+		return false
+	}
+	return time.Duration(time.Now().UnixNano()-atomic.LoadInt64(&s.active[i])) >= s.idle
+}
+
+// close closes both ends.
+func (s *splice) close() {
+	s.closeWith("")
+}
+
+// kill closes both ends and reports ReasonKilled.
+func (s *splice) kill() {
+	s.closeWith(ReasonKilled)
+}
+
+func (s *splice) closeWith(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if reason != "" {
+		s.reason = reason
+	}
+	_ = s.conns[0].Close()
+	_ = s.conns[1].Close()
+}
+
+var errCloseWrite = errors.New("CloseWrite not supported")
+
+// closeWrite shuts down the writing side of c if possible.
+func closeWrite(c io.Writer) error {
+	if b, ok := c.(*BufferedConn); ok {
+		c = b.Conn
+	}
+	cw, ok := c.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return errCloseWrite
+	}
+	return cw.CloseWrite()
+}
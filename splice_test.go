@@ -0,0 +1,174 @@
+package proxima
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(tb, err)
+	defer func() {
+		assert.NoError(tb, l.Close())
+	}()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		assert.NoError(tb, err)
+		accepted <- conn
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(tb, err)
+	return c.(*net.TCPConn), (<-accepted).(*net.TCPConn)
+}
+
+func TestSplice(t *testing.T) {
+	t.Run("half-close", func(t *testing.T) {
+		client, inbound := tcpPair(t)
+		outbound, server := tcpPair(t)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			Splice(inbound, outbound)
+		}()
+
+		// The client sends a request and closes its writing side, then waits for the response.
+		_, err := client.Write([]byte("ping"))
+		assert.NoError(t, err)
+		assert.NoError(t, client.CloseWrite())
+
+		b, err := ioutil.ReadAll(server)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+
+		_, err = server.Write([]byte("pong"))
+		assert.NoError(t, err)
+		assert.NoError(t, server.Close())
+
+		b, err = ioutil.ReadAll(client)
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(b))
+		assert.NoError(t, client.Close())
+
+		<-done
+	})
+
+	t.Run("buffered connections", func(t *testing.T) {
+		client, inbound := tcpPair(t)
+		outbound, server := tcpPair(t)
+		defer func() {
+			assert.NoError(t, client.Close())
+			assert.NoError(t, server.Close())
+		}()
+
+		go Splice(NewBufferedConn(inbound, nil), NewBufferedConn(outbound, nil))
+
+		_, err := client.Write([]byte("ping"))
+		assert.NoError(t, err)
+		b := make([]byte, 4)
+		_, err = io.ReadFull(server, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+	})
+}
+
+func TestSpliceIdle(t *testing.T) {
+	t.Run("idle", func(t *testing.T) {
+		client, inbound := tcpPair(t)
+		outbound, server := tcpPair(t)
+		defer func() {
+			assert.NoError(t, client.Close())
+			assert.NoError(t, server.Close())
+		}()
+
+		start := time.Now()
+		SpliceIdle(inbound, outbound, 50*time.Millisecond)
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+		_, err := client.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("active in one direction", func(t *testing.T) {
+		client, inbound := tcpPair(t)
+		outbound, server := tcpPair(t)
+		defer func() {
+			assert.NoError(t, client.Close())
+		}()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			SpliceIdle(inbound, outbound, 50*time.Millisecond)
+		}()
+
+		// The server keeps sending data longer than the idle timeout while the client sends nothing.
+		for i := 0; i < 10; i++ {
+			_, err := server.Write([]byte("x"))
+			assert.NoError(t, err)
+			time.Sleep(20 * time.Millisecond)
+		}
+		assert.NoError(t, server.Close())
+
+		b, err := ioutil.ReadAll(client)
+		assert.NoError(t, err)
+		assert.Equal(t, "xxxxxxxxxx", string(b))
+
+		<-done
+	})
+}
+
+func BenchmarkSplice(b *testing.B) {
+	chunk := make([]byte, 32*1024)
+
+	bench := func(b *testing.B, wrap func(net.Conn) net.Conn) {
+		client, inbound := tcpPair(b)
+		outbound, server := tcpPair(b)
+		go Splice(wrap(inbound), wrap(outbound))
+
+		received := make(chan int64)
+		go func() {
+			n, _ := io.Copy(ioutil.Discard, server)
+			received <- n
+		}()
+
+		b.SetBytes(int64(len(chunk)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Write(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+		_ = client.CloseWrite()
+		if n := <-received; n != int64(b.N*len(chunk)) {
+			b.Fatalf("received %d bytes", n)
+		}
+		b.StopTimer()
+
+		_ = client.Close()
+		_ = server.Close()
+	}
+
+	b.Run("tcp", func(b *testing.B) {
+		bench(b, func(c net.Conn) net.Conn {
+			return c
+		})
+	})
+
+	b.Run("userspace", func(b *testing.B) {
+		// Hiding the concrete type disables the fast path.
+		bench(b, func(c net.Conn) net.Conn {
+			return struct{ net.Conn }{c}
+		})
+	})
+}
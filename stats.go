@@ -0,0 +1,195 @@
+package proxima
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+)
+
+const (
+	// latencyWeight is the weight of the latest sample in the moving average of handshake latencies.
+	latencyWeight = 0.2
+	// failureWindow is the number of the latest attempts the failure rate is calculated over.
+	failureWindow = 20
+	// idleProxyTTL is how long the state of a proxy is kept after it's used last. Proxy names built from URI templates
+	// may be countless, so the state of the proxies no longer in use has to go.
+	idleProxyTTL = time.Hour
+)
+
+// proxyStats keeps track of the handshake latencies and the outcomes of the latest attempts of proxies.
+type proxyStats struct {
+	mu        sync.Mutex
+	proxies   map[string]*proxyStat
+	nextSweep time.Time
+}
+
+type proxyStat struct {
+	// latency is the exponentially weighted moving average of handshake latencies in milliseconds.
+	latency float64
+	samples int
+	// outcomes is a ring buffer of the latest attempts, true for failures.
+	outcomes [failureWindow]bool
+	attempts int
+	last     time.Time
+}
+
+func newProxyStats() *proxyStats {
+	return &proxyStats{
+		proxies: map[string]*proxyStat{},
+	}
+}
+
+// stat returns the statistics of the proxy to update. It must be called with the lock held.
+func (s *proxyStats) stat(proxy string) *proxyStat {
+	now := time.Now()
+	s.sweep(now)
+	st, ok := s.proxies[proxy]
+	if !ok {
+		st = &proxyStat{}
+		s.proxies[proxy] = st
+	}
+	st.last = now
+	return st
+}
+
+// sweep removes the statistics of the proxies idle for idleProxyTTL once in a while. It must be called with the lock
+// held.
+func (s *proxyStats) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	s.nextSweep = now.Add(sweepInterval)
+
+	for p, st := range s.proxies {
+		if now.Sub(st.last) >= idleProxyTTL {
+			delete(s.proxies, p)
+		}
+	}
+}
+
+// handshake records the time taken to connect to the target via the proxy.
+func (s *proxyStats) handshake(proxy string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stat(proxy)
+	ms := float64(d) / float64(time.Millisecond)
+	if st.samples == 0 {
+		st.latency = ms
+	} else {
+		st.latency = latencyWeight*ms + (1-latencyWeight)*st.latency
+	}
+	st.samples++
+}
+
+// outcome records whether an attempt via the proxy failed.
+func (s *proxyStats) outcome(proxy string, failed bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stat(proxy)
+	st.outcomes[st.attempts%failureWindow] = failed
+	st.attempts++
+}
+
+// snapshot returns the handshake latency of the proxy in milliseconds, whether it's measured, and the failure rate of
+// the latest attempts.
+func (s *proxyStats) snapshot(proxy string) (float64, bool, float64) {
+	if s == nil {
+		return 0, false, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.proxies[proxy]
+	if !ok {
+		return 0, false, 0
+	}
+	n := st.attempts
+	if n > failureWindow {
+		n = failureWindow
+	}
+	var failures int
+	for _, f := range st.outcomes[:n] {
+		if f {
+			failures++
+		}
+	}
+	var rate float64
+	if n > 0 {
+		rate = float64(failures) / float64(n)
+	}
+	return st.latency, st.samples > 0, rate
+}
+
+// known returns the proxies with statistics sorted.
+func (s *proxyStats) known() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := make([]string, 0, len(s.proxies))
+	for p := range s.proxies {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	return ps
+}
+
+// proxyStats unifies the proxy and the list of its statistics. The proxy is any solution of tunnel/2. If the proxy is a
+// variable, it enumerates the proxies which have been attempted or have live connections.
+func (s *Switcher) proxyStats(proxy, stats engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+	switch p := env.Resolve(proxy).(type) {
+	case engine.Variable:
+		known := map[string]struct{}{}
+		for _, p := range s.stats.known() {
+			known[p] = struct{}{}
+		}
+		for _, l := range s.conns.live() {
+			known[l.proxy] = struct{}{}
+		}
+		ps := make([]string, 0, len(known))
+		for p := range known {
+			ps = append(ps, p)
+		}
+		sort.Strings(ps)
+
+		ks := make([]func(context.Context) *engine.Promise, len(ps))
+		for i := range ps {
+			p := ps[i]
+			ks[i] = func(context.Context) *engine.Promise {
+				given := engine.Compound{Args: []engine.Term{proxy, stats}}
+				actual := engine.Compound{Args: []engine.Term{engine.Atom(p), s.statsTerm(p)}}
+				return engine.Unify(&given, &actual, k, env)
+			}
+		}
+		return engine.Delay(ks...)
+	default:
+		name, err := proxyName(p, env)
+		if err != nil {
+			return engine.Error(err)
+		}
+		return engine.Unify(stats, s.statsTerm(name), k, env)
+	}
+}
+
+// statsTerm returns the statistics of the proxy as a list of connections(N), latency(Ms), and failure_rate(Rate).
+// latency(Ms) is omitted until a handshake via the proxy succeeds.
+func (s *Switcher) statsTerm(proxy string) engine.Term {
+	latency, measured, rate := s.stats.snapshot(proxy)
+	ts := []engine.Term{
+		engine.Atom("connections").Apply(engine.Integer(s.conns.count(proxy))),
+	}
+	if measured {
+		ts = append(ts, engine.Atom("latency").Apply(engine.Float(latency)))
+	}
+	ts = append(ts, engine.Atom("failure_rate").Apply(engine.Float(rate)))
+	return engine.List(ts...)
+}
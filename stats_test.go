@@ -0,0 +1,150 @@
+package proxima
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyStats(t *testing.T) {
+	const proxy = "http://localhost:8081"
+
+	t.Run("latency", func(t *testing.T) {
+		s := newProxyStats()
+		_, measured, _ := s.snapshot(proxy)
+		assert.False(t, measured)
+
+		s.handshake(proxy, 100*time.Millisecond)
+		latency, measured, _ := s.snapshot(proxy)
+		assert.True(t, measured)
+		assert.Equal(t, 100.0, latency)
+
+		s.handshake(proxy, 200*time.Millisecond)
+		latency, _, _ = s.snapshot(proxy)
+		assert.InDelta(t, 120.0, latency, 1e-9)
+	})
+
+	t.Run("failure rate", func(t *testing.T) {
+		s := newProxyStats()
+		s.outcome(proxy, true)
+		s.outcome(proxy, false)
+		s.outcome(proxy, false)
+		s.outcome(proxy, false)
+		_, _, rate := s.snapshot(proxy)
+		assert.Equal(t, 0.25, rate)
+
+		// Only the latest attempts count.
+		for i := 0; i < failureWindow; i++ {
+			s.outcome(proxy, false)
+		}
+		_, _, rate = s.snapshot(proxy)
+		assert.Equal(t, 0.0, rate)
+	})
+
+	t.Run("idle proxies are removed", func(t *testing.T) {
+		s := newProxyStats()
+		s.outcome(proxy, true)
+		s.proxies[proxy].last = time.Now().Add(-idleProxyTTL)
+		s.nextSweep = time.Time{}
+
+		s.outcome("http://localhost:8082", false)
+		assert.Equal(t, []string{"http://localhost:8082"}, s.known())
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var s *proxyStats
+		s.handshake(proxy, time.Second)
+		s.outcome(proxy, true)
+		_, measured, rate := s.snapshot(proxy)
+		assert.False(t, measured)
+		assert.Equal(t, 0.0, rate)
+		assert.Empty(t, s.known())
+	})
+}
+
+func TestSwitcher_ProxyStats(t *testing.T) {
+	const (
+		a = "http://localhost:8081"
+		b = "http://localhost:8082"
+		c = "http://localhost:8083"
+	)
+
+	s, err := New(nil)
+	assert.NoError(t, err)
+
+	s.stats.handshake(a, 300*time.Millisecond)
+	s.stats.handshake(b, 100*time.Millisecond)
+	s.stats.outcome(b, true)
+	s.stats.outcome(b, false)
+	assert.True(t, s.conns.acquire(context.Background(), a, connectionLimit{}))
+	assert.True(t, s.conns.acquire(context.Background(), b, connectionLimit{}))
+	assert.True(t, s.conns.acquire(context.Background(), b, connectionLimit{}))
+
+	t.Run("stats", func(t *testing.T) {
+		var sol struct {
+			Stats []engine.Term
+		}
+		assert.NoError(t, s.QuerySolution(`proxy_stats(?, Stats).`, b).Scan(&sol))
+		assert.Equal(t, []engine.Term{
+			&engine.Compound{Functor: "connections", Args: []engine.Term{engine.Integer(2)}},
+			&engine.Compound{Functor: "latency", Args: []engine.Term{engine.Float(100)}},
+			&engine.Compound{Functor: "failure_rate", Args: []engine.Term{engine.Float(0.5)}},
+		}, sol.Stats)
+
+		// Not measured yet.
+		assert.NoError(t, s.QuerySolution(`proxy_stats(?, Stats).`, c).Scan(&sol))
+		assert.Equal(t, []engine.Term{
+			&engine.Compound{Functor: "connections", Args: []engine.Term{engine.Integer(0)}},
+			&engine.Compound{Functor: "failure_rate", Args: []engine.Term{engine.Float(0)}},
+		}, sol.Stats)
+	})
+
+	t.Run("enumerate", func(t *testing.T) {
+		var sol struct {
+			Proxies []string
+		}
+		assert.NoError(t, s.QuerySolution(`findall(P, proxy_stats(P, _), Proxies).`).Scan(&sol))
+		assert.Equal(t, []string{a, b}, sol.Proxies)
+	})
+
+	t.Run("least_connections", func(t *testing.T) {
+		var sol struct {
+			Proxies []string
+		}
+		assert.NoError(t, s.QuerySolution(`findall(P, least_connections([?, ?, ?], P), Proxies).`, b, a, c).Scan(&sol))
+		assert.Equal(t, []string{c, a, b}, sol.Proxies)
+	})
+
+	t.Run("fastest", func(t *testing.T) {
+		var sol struct {
+			Proxies []string
+		}
+		assert.NoError(t, s.QuerySolution(`findall(P, fastest([?, ?, ?], P), Proxies).`, c, a, b).Scan(&sol))
+		assert.Equal(t, []string{b, a, c}, sol.Proxies)
+	})
+
+	t.Run("mixed candidates", func(t *testing.T) {
+		s.stats.handshake("direct(10.0.0.1)", 50*time.Millisecond)
+		assert.True(t, s.conns.acquire(context.Background(), "chain([localhost:3128,localhost:3129])", connectionLimit{}))
+
+		var sol struct {
+			Proxies []engine.Term
+		}
+		assert.NoError(t, s.QuerySolution(`findall(P, fastest([?, direct('10.0.0.1'), chain(['localhost:3128', 'localhost:3129'])], P), Proxies).`, a).Scan(&sol))
+		assert.Equal(t, []engine.Term{
+			engine.Atom("direct").Apply(engine.Atom("10.0.0.1")),
+			engine.Atom(a),
+			engine.Atom("chain").Apply(engine.List(engine.Atom("localhost:3128"), engine.Atom("localhost:3129"))),
+		}, sol.Proxies)
+
+		assert.NoError(t, s.QuerySolution(`findall(P, least_connections([?, direct('10.0.0.1'), chain(['localhost:3128', 'localhost:3129'])], P), Proxies).`, b).Scan(&sol))
+		assert.Equal(t, []engine.Term{
+			engine.Atom("direct").Apply(engine.Atom("10.0.0.1")),
+			engine.Atom("chain").Apply(engine.List(engine.Atom("localhost:3128"), engine.Atom("localhost:3129"))),
+			engine.Atom(b),
+		}, sol.Proxies)
+	})
+}
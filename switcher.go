@@ -4,15 +4,21 @@ import (
 	"context"
 	_ "embed"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/ichiban/prolog"
 	"github.com/ichiban/prolog/engine"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -26,34 +32,142 @@ var predicates string
 
 type Switcher struct {
 	*prolog.Interpreter
+
+	// Authenticate checks the credentials of clients if set. It takes precedence over authenticate/2.
+	Authenticate Authenticator
+
+	// IdleTimeout closes tunnels without traffic in either direction for the duration if set.
+	IdleTimeout time.Duration
+
+	// ConnectTimeout gives up connecting to proxies after the duration if set.
+	ConnectTimeout time.Duration
+
+	// HandshakeTimeout gives up waiting for proxies to respond to handshakes, e.g. CONNECT, after the duration if set.
+	// It also bounds SOCKS5 clients to negotiate, or defaultSOCKS5Negotiation if not set.
+	HandshakeTimeout time.Duration
+
+	// The timeouts above can be overridden per proxy by proxy_option(Proxy, timeout(Kind, Ms)).
+
+	// TunnelFinished is called with every tunnel once it's closed if set.
+	TunnelFinished func(ctx context.Context, info TunnelInfo)
+
+	// Metrics collects metrics if set.
+	Metrics *Metrics
+
+	// Admin keeps track of live tunnels and drained proxies if set.
+	Admin *Admin
+
+	// Health answers health/2 and healthy/1 with the results of health checks if set.
+	Health *HealthChecker
+
+	probes   *probeCache
+	exits    *exitIPs
+	circuits *circuitBreaker
+	conns    *connections
+	stats    *proxyStats
+
+	hopOptionsCache *hopOptionsCache
+
+	hasAuthenticate   bool
+	hasTunnelFinished bool
+	userinfoTerms     bool
+	circuit           circuitConfig
 }
 
 func New(files []string) (*Switcher, error) {
+	texts, err := readFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSwitcher(texts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.configure(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newSwitcher returns a Switcher which has consulted the texts of the configuration.
+// The settings declared in the configuration take effect once configure is called.
+func newSwitcher(texts ...string) (*Switcher, error) {
 	s := Switcher{
-		Interpreter: prolog.New(nil, nil),
+		Interpreter:     prolog.New(nil, nil),
+		probes:          newProbeCache(),
+		exits:           newExitIPs(),
+		circuits:        newCircuitBreaker(),
+		conns:           newConnections(),
+		stats:           newProxyStats(),
+		hopOptionsCache: newHopOptionsCache(),
 	}
 
 	s.Register3("host_port", HostPort)
 	s.Register3("uri_template", URITemplate)
-	s.Register4("probe", Probe)
+	s.Register4("probe", func(proxy, target, options, status engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+		return probe(s.Metrics, s.probes, proxy, target, options, status, nil, k, env)
+	})
+	s.Register5("probe", func(proxy, target, options, status, result engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+		return probe(s.Metrics, s.probes, proxy, target, options, status, result, k, env)
+	})
+	s.Register4("exit_ip", s.exitIP)
+	s.Register2("exit_ip_used", s.exitIPUsed)
+	s.Register2("circuit", func(proxy, state engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+		return s.circuits.circuit(proxy, state, k, env)
+	})
+	s.Register2("connections", func(proxy, n engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+		return s.conns.connections(proxy, n, k, env)
+	})
+	s.Register2("proxy_stats", s.proxyStats)
 	s.Register3("log", Log)
+	s.Register3("htpasswd", Htpasswd)
+	s.Register2("health", func(proxy, status engine.Term, k func(*engine.Env) *engine.Promise, env *engine.Env) *engine.Promise {
+		return s.Health.health(proxy, status, k, env)
+	})
 
 	if err := s.Exec(predicates); err != nil {
 		return nil, err
 	}
 
-	for _, file := range files {
-		b, err := ioutil.ReadFile(file)
-		if err != nil {
+	for _, text := range texts {
+		if err := s.Exec(text); err != nil {
 			return nil, err
 		}
+	}
+
+	return &s, nil
+}
+
+// configure reads the settings declared in the configuration.
+func (s *Switcher) configure() error {
+	s.hasAuthenticate = s.defined("authenticate", 2)
+	s.hasTunnelFinished = s.defined("tunnel_finished", 2)
+	s.userinfoTerms = s.QuerySolution(`userinfo_syntax(terms).`).Err() == nil
+	c, err := s.circuitConfig()
+	if err != nil {
+		return err
+	}
+	s.circuit = c
+	return nil
+}
 
-		if err := s.Exec(string(b)); err != nil {
+// readFiles returns the contents of the files.
+func readFiles(files []string) ([]string, error) {
+	texts := make([]string, len(files))
+	for i, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
 			return nil, err
 		}
+		texts[i] = string(b)
 	}
+	return texts, nil
+}
 
-	return &s, nil
+// defined reports whether the predicate is defined in the configuration files.
+func (s *Switcher) defined(name string, arity int) bool {
+	pi := engine.Atom("/").Apply(engine.Atom(name), engine.Integer(arity))
+	return s.QuerySolution(`current_predicate(?).`, pi).Err() == nil
 }
 
 type contextKey struct{}
@@ -61,13 +175,23 @@ type contextKey struct{}
 var LogKey contextKey
 
 func (s *Switcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log := hlog.FromRequest(r)
-
-	if r.Method != http.MethodConnect {
+	rec := statusRecorder{ResponseWriter: w}
+	switch {
+	case r.Method == http.MethodConnect:
+		s.serveConnect(&rec, r)
+		s.Metrics.request("connect", rec.status)
+	case r.URL.IsAbs():
+		s.serveForward(&rec, r)
+		s.Metrics.request("forward", rec.status)
+	default:
+		log := hlog.FromRequest(r)
 		log.Error().Str("method", r.Method).Msg(http.StatusText(http.StatusMethodNotAllowed))
 		http.Error(w, "", http.StatusMethodNotAllowed)
-		return
 	}
+}
+
+func (s *Switcher) serveConnect(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
 
 	u, err := ParseURL(scheme + r.RequestURI)
 	if err != nil {
@@ -76,95 +200,607 @@ func (s *Switcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	target, err := net.ResolveTCPAddr("tcp", u.Host)
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		log.Err(err).Msg("net.SplitHostPort() failed")
+		http.Error(w, "", http.StatusUnprocessableEntity)
+		return
+	}
+	target := TargetAddr(u.Host)
+
+	user, password, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := s.options(r, r.RequestURI, user, password)
 	if err != nil {
-		log.Err(err).Msg("net.ResolveTCPAddr() failed")
+		log.Err(err).Msg("s.options() failed")
 		http.Error(w, "", http.StatusUnprocessableEntity)
 		return
 	}
 
-	opts, err := s.options(r)
+	rid, _ := hlog.IDFromRequest(r)
+
+	// Dial and handshake with upstream proxies before answering the client so that we can fail over to the next one.
+	a, err := s.connect(r.Context(), log, rid, opts, target, r.Header)
+	if err != nil {
+		log.Err(err).Msg("s.connect() failed")
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		http.Error(w, "", http.StatusBadGateway)
+		log.Info().Msg("no tunnels")
+		return
+	}
+	defer a.release()
+	inbound, tlog, name := a.conn, a.log, a.proxy.name
+
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		tlog.Error().Msg("hijacking not supported")
+		s.failure(rid, a.proxy, FailureHijack, nil)
+		_ = inbound.Close()
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		tlog.Err(err).Msg("h.Hijack() failed")
+		s.failure(rid, a.proxy, FailureHijack, err)
+		_ = inbound.Close()
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	// The client may have sent data right after the CONNECT request, e.g. TLS ClientHello.
+	outbound := NewBufferedConn(conn, rw.Reader)
+
+	if err := a.resp.Write(outbound); err != nil {
+		tlog.Warn().Err(err).Msg("resp.Write() failed")
+		_ = inbound.Close()
+		_ = outbound.Close()
+		return
+	}
+
+	info := TunnelInfo{
+		ID:     rid,
+		Remote: r.RemoteAddr,
+		Target: string(target),
+		User:   user,
+		Proxy:  name,
+	}
+	info.TunnelStats = s.splice(tlog, info, a.proxy, a.start, a.handshake, inbound, outbound)
+	s.finish(r.Context(), tlog, info)
+}
+
+func (s *Switcher) serveForward(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+
+	target := urlHostPort(r.URL)
+
+	user, password, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := s.options(r, target, user, password)
 	if err != nil {
 		log.Err(err).Msg("s.options() failed")
 		http.Error(w, "", http.StatusUnprocessableEntity)
 		return
 	}
 
-	ctx := r.Context()
+	rid, _ := hlog.IDFromRequest(r)
+
+	// Once the request body is sent to a proxy, we can't send it again to another one.
+	retryable := r.Body == nil || r.Body == http.NoBody
+
+	// Only HTTP proxies can forward requests other than http, e.g. https, as is. The others would receive plain HTTP.
+	var attempted, unsupported bool
+
+	ok, err = s.each(r.Context(), log, opts, func(log zerolog.Logger, proxy *proxy) (bool, error) {
+		if r.URL.Scheme != "http" && !proxy.isHTTP() {
+			log.Info().Str("scheme", r.URL.Scheme).Msg("scheme not supported")
+			unsupported = true
+			return false, nil
+		}
+
+		attempted = true
+		s.Metrics.attempt(proxy.label)
+		inbound, err := proxy.dial(r.Context(), TargetAddr(target))
+		if err != nil {
+			log.Warn().Err(err).Msg("proxy.dial() failed")
+			s.failure(rid, proxy, FailureDial, err)
+			return false, nil
+		}
+		defer func() {
+			_ = inbound.Close()
+		}()
+
+		var resp *http.Response
+		if proxy.isHTTP() {
+			err = withDeadline(r.Context(), inbound, proxy.last().timeouts.handshake, func(context.Context) error {
+				var err error
+				resp, err = Forward(inbound, r, upstreamHeader(r.Header, proxy.last().url))
+				return err
+			})
+		} else {
+			if _, err := proxy.handshake(r.Context(), inbound, TargetAddr(target), nil); err != nil {
+				log.Warn().Err(err).Msg("proxy.handshake() failed")
+				s.failure(rid, proxy, failureReason(err), err)
+				return false, nil
+			}
+			resp, err = Send(inbound, r, endToEndHeader(r.Header))
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("Forward() failed")
+			s.failure(rid, proxy, FailureForward, err)
+			return false, notRetryable(retryable)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			log.Warn().Str("status", resp.Status).Msg("Forward() rejected")
+			s.failure(rid, proxy, FailureStatus, &StatusError{Status: resp.Status, StatusCode: resp.StatusCode})
+			return false, notRetryable(retryable)
+		}
+
+		log.Info().Int("status", resp.StatusCode).Msg("forward start")
+		header := w.Header()
+		for k, vs := range endToEndHeader(resp.Header) {
+			header[k] = vs
+		}
+		w.WriteHeader(resp.StatusCode)
+		n, err := io.Copy(w, resp.Body)
+		if err != nil {
+			log.Warn().Err(err).Int64("bytes", n).Msg("io.Copy() failed")
+			return true, nil
+		}
+		log.Info().Int64("bytes", n).Msg("forward finish")
+
+		return true, nil
+	})
+	switch {
+	case errors.Is(err, errBodySent):
+		http.Error(w, "", http.StatusBadGateway)
+		log.Info().Msg("no retries")
+		return
+	case err != nil:
+		log.Err(err).Msg("s.each() failed")
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	case ok:
+		return
+	case unsupported && !attempted:
+		http.Error(w, "", http.StatusBadRequest)
+		log.Info().Str("scheme", r.URL.Scheme).Msg("no proxies for the scheme")
+		return
+	}
+
+	http.Error(w, "", http.StatusBadGateway)
+	log.Info().Msg("no proxies")
+}
+
+// errBodySent stops forwarding a request to the next proxy since its body has been consumed.
+var errBodySent = errors.New("request body already sent")
+
+// notRetryable returns errBodySent unless the request is retryable.
+func notRetryable(retryable bool) error {
+	if retryable {
+		return nil
+	}
+	return errBodySent
+}
+
+// ServeSOCKS5 accepts connections on l and serves them as a SOCKS5 server until l is closed.
+func (s *Switcher) ServeSOCKS5(ctx context.Context, l net.Listener) error {
+	return acceptLoop(ctx, l, func(conn net.Conn) {
+		s.serveSOCKS5(ctx, conn)
+	})
+}
+
+// maxAcceptDelay is the maximum delay before accepting again after a temporary error.
+const maxAcceptDelay = time.Second
+
+// acceptLoop accepts connections on l and serves each of them in a new goroutine until l is closed. Temporary errors
+// such as running out of file descriptors are retried with backoff as http.Server does.
+func acceptLoop(ctx context.Context, l net.Listener, serve func(conn net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Temporary() {
+				return err
+			}
+
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			if log, ok := ctx.Value(LogKey).(*zerolog.Logger); ok {
+				log.Warn().Err(err).Dur("delay", delay).Msg("l.Accept() failed")
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go serve(conn)
+	}
+}
+
+func (s *Switcher) serveSOCKS5(ctx context.Context, conn net.Conn) {
+	rid := xid.New()
+	base := zerolog.Nop()
+	if l, ok := ctx.Value(LogKey).(*zerolog.Logger); ok {
+		base = *l
+	}
+	log := base.With().
+		Str("remote", conn.RemoteAddr().String()).
+		Str("rid", rid.String()).
+		Logger()
+
+	var auth func(user, password string) (bool, error)
+	if s.authRequired() {
+		auth = func(user, password string) (bool, error) {
+			return s.authenticate(context.WithValue(ctx, LogKey, &log), user, password)
+		}
+	}
+
+	// Clients which connect and send nothing shouldn't hold the connection forever.
+	negotiation := s.HandshakeTimeout
+	if negotiation == 0 {
+		negotiation = defaultSOCKS5Negotiation
+	}
+	_ = conn.SetDeadline(time.Now().Add(negotiation))
+	req, err := readSOCKS5Request(conn, auth)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Err(err).Msg("readSOCKS5Request() failed")
+		if errors.Is(err, errSOCKSAuthentication) {
+			s.Metrics.request("socks5", http.StatusProxyAuthRequired)
+		} else {
+			s.Metrics.request("socks5", http.StatusBadRequest)
+		}
+		_ = conn.Close()
+		return
+	}
+
+	target := TargetAddr(req.Target)
+
+	opts, err := s.optionList(rid, conn.RemoteAddr().String(), req.Target, req.User, req.Password)
+	if err != nil {
+		log.Err(err).Msg("s.optionList() failed")
+		s.Metrics.request("socks5", http.StatusUnprocessableEntity)
+		_ = writeSOCKS5Reply(conn, socksReplyGeneralFailure, nil)
+		_ = conn.Close()
+		return
+	}
+
+	// The client may go away while connecting to the target.
+	cctx, cancel, stop := watchClose(ctx, conn)
+	a, err := s.connect(cctx, &log, rid, opts, target, nil)
+	conn = stop()
+	cancel()
+	if err != nil {
+		log.Err(err).Msg("s.connect() failed")
+		s.Metrics.request("socks5", http.StatusInternalServerError)
+		_ = writeSOCKS5Reply(conn, socksReplyGeneralFailure, nil)
+		_ = conn.Close()
+		return
+	}
+	if a == nil {
+		s.Metrics.request("socks5", http.StatusBadGateway)
+		_ = writeSOCKS5Reply(conn, socksReplyHostUnreachable, nil)
+		_ = conn.Close()
+		log.Info().Msg("no tunnels")
+		return
+	}
+	defer a.release()
+	inbound, tlog, name := a.conn, a.log, a.proxy.name
+
+	if err := writeSOCKS5Reply(conn, socksReplySucceeded, inbound.LocalAddr()); err != nil {
+		tlog.Err(err).Msg("writeSOCKS5Reply() failed")
+		s.Metrics.request("socks5", http.StatusInternalServerError)
+		_ = inbound.Close()
+		_ = conn.Close()
+		return
+	}
+	s.Metrics.request("socks5", http.StatusOK)
+
+	info := TunnelInfo{
+		ID:     rid,
+		Remote: conn.RemoteAddr().String(),
+		Target: req.Target,
+		User:   req.User,
+		Proxy:  name,
+	}
+	info.TunnelStats = s.splice(tlog, info, a.proxy, a.start, a.handshake, inbound, conn)
+	s.finish(ctx, tlog, info)
+}
+
+// each queries tunnel/2 with opts and calls f with each proxy until f returns true. If f returns an error, it stops
+// there and returns the error.
+func (s *Switcher) each(ctx context.Context, log *zerolog.Logger, opts engine.Term, f func(log zerolog.Logger, proxy *proxy) (bool, error)) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var ferr error
+	ok, err := s.eachN(ctx, log, opts, 1, func(cs []candidate) int {
+		ok, err := f(cs[0].log, cs[0].proxy)
+		if err != nil {
+			// eachN stops once ctx is done.
+			ferr = err
+			cancel()
+			return -1
+		}
+		if !ok {
+			return -1
+		}
+		// f is done with the connection.
+		cs[0].release()
+		return 0
+	})
+	if ferr != nil {
+		return false, ferr
+	}
+	return ok, err
+}
+
+// candidate is a proxy to attempt.
+type candidate struct {
+	log   zerolog.Logger
+	proxy *proxy
+	// release uncounts the connection via the proxy.
+	release func()
+}
+
+// eachN queries tunnel/2 with opts and calls f with up to n proxies at a time until f returns the index of the proxy
+// which succeeded. f returns -1 if none of them succeeded. The connection via each proxy is counted until its release
+// is called, which is up to f for the proxy succeeded.
+func (s *Switcher) eachN(ctx context.Context, log *zerolog.Logger, opts engine.Term, n int, f func(cs []candidate) int) (bool, error) {
 	ctx = context.WithValue(ctx, LogKey, log)
 
+	// Time spent in f doesn't count as the query latency.
+	var elapsed time.Duration
+	start := time.Now()
+	defer func() {
+		s.Metrics.queryDuration(elapsed + time.Since(start))
+	}()
+
 	sols, err := s.QueryContext(ctx, `tunnel(Proxy, ?).`, opts)
 	if err != nil {
-		log.Err(err).Msg("s.Query() failed")
-		http.Error(w, "", http.StatusInternalServerError)
-		return
+		return false, err
 	}
 	defer func() {
 		_ = sols.Close()
 	}()
 
+	var cs []candidate
+	try := func() (bool, error) {
+		elapsed += time.Since(start)
+		i := f(cs)
+		start = time.Now()
+		for j, c := range cs {
+			if j == i {
+				s.circuits.success(c.proxy.name)
+				s.exits.use(c.proxy.name)
+				s.stats.outcome(c.proxy.name, false)
+				continue
+			}
+			s.circuits.release(c.proxy.name)
+			c.release()
+		}
+		cs = cs[:0]
+		if i >= 0 {
+			return true, nil
+		}
+
+		// The client has gone away.
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
 	for sols.Next() {
-		var s struct {
-			Proxy string
+		var sol struct {
+			Proxy engine.Term
 		}
-		if err := sols.Scan(&s); err != nil {
+		if err := sols.Scan(&sol); err != nil {
 			log.Err(err).Msg("sols.Scan() failed")
 			continue
 		}
 
-		log := log.With().Str("proxy", s.Proxy).Logger()
-
-		u, err := url.Parse(scheme + s.Proxy)
+		p, err := s.proxy(ctx, sol.Proxy)
 		if err != nil {
-			log.Err(err).Msg("url.Parse(s.Proxy) failed")
+			log.Err(err).Msg("s.proxy() failed")
 			continue
 		}
 
-		header := make(http.Header, len(r.Header)+1)
-		for k, vs := range r.Header {
-			header[k] = vs
-		}
-		if u.User != nil {
-			header.Set(proxyAuthorization, prefix+base64.StdEncoding.EncodeToString([]byte(u.User.String())))
-		}
+		log := log.With().Str("proxy", p.label).Logger()
 
-		inbound, err := net.Dial("tcp", u.Host)
-		if err != nil {
-			log.Warn().Err(err).Msg("net.Dial() failed")
+		if s.Admin.Drained(p.label) {
+			log.Info().Msg("proxy drained")
 			continue
 		}
 
-		h, ok := w.(http.Hijacker)
-		if !ok {
+		if !s.circuits.allow(s.circuit, p.name) {
+			log.Info().Msg("circuit open")
 			continue
 		}
-		outbound, _, err := h.Hijack()
+
+		l, err := s.connectionLimit(ctx, p.term)
 		if err != nil {
-			log.Err(err).Msg("h.Hijack() failed")
+			log.Err(err).Msg("s.connectionLimit() failed")
+			s.circuits.release(p.name)
 			continue
 		}
-
-		log.Info().Msg("tunnel start")
-		if err := Tunnel(inbound, outbound, target, r.Header); err != nil {
-			log.Warn().Err(err).Msg("Tunnel() failed")
+		if !s.conns.acquire(ctx, p.name, l) {
+			log.Info().Msg("proxy at capacity")
+			s.circuits.release(p.name)
 			continue
 		}
-		log.Info().Msg("tunnel finish")
 
-		return
+		name := p.name
+		cs = append(cs, candidate{log: log, proxy: p, release: func() {
+			s.conns.release(name)
+		}})
+		if len(cs) < n {
+			continue
+		}
+		if ok, err := try(); ok || err != nil {
+			return ok, err
+		}
 	}
 
 	if err := sols.Err(); err != nil {
 		log.Err(err).Msg("sols.Err() failed")
 	}
 
-	http.Error(w, "", http.StatusBadGateway)
-	log.Info().Msg("no tunnels")
+	if len(cs) > 0 {
+		return try()
+	}
+	return false, nil
+}
+
+// failure records the failed attempt to connect via the proxy.
+func (s *Switcher) failure(rid xid.ID, p *proxy, reason string, err error) {
+	s.Metrics.failure(p.label, reason)
+
+	// Only failures of the proxy itself count toward opening the circuit and the failure rate.
+	switch reason {
+	case FailureDial, FailureHandshake, FailureStatus:
+		if !errors.Is(err, context.Canceled) {
+			s.circuits.failure(s.circuit, p.name)
+			s.stats.outcome(p.name, true)
+		}
+	}
+
+	f := Failure{
+		ID:     rid,
+		Time:   time.Now(),
+		Reason: reason,
+	}
+	if err != nil {
+		f.Error = err.Error()
+	}
+	s.Admin.failure(p.label, f)
+}
+
+// splice copies data between inbound and outbound as the tunnel via p described by info until it's closed.
+func (s *Switcher) splice(log zerolog.Logger, info TunnelInfo, p *proxy, start time.Time, handshake time.Duration, inbound, outbound net.Conn) TunnelStats {
+	log.Info().Msg("tunnel start")
+	s.Metrics.tunnelStart(p.label)
+
+	// Admin reports the progress of tunnels in progress.
+	var interval time.Duration
+	if s.Admin != nil {
+		interval = progressInterval
+	}
+	sp := newSplice(inbound, outbound, p.timeouts.idle, interval)
+	done := s.Admin.open(LiveTunnel{
+		ID:     info.ID,
+		Remote: info.Remote,
+		Target: info.Target,
+		User:   info.User,
+		Proxy:  p.label,
+		Start:  start,
+	}, sp)
+	defer done()
+
+	stats := newTunnelStats(start, handshake, sp.wait())
+	s.Metrics.tunnelFinish(p.label, stats)
+	return stats
 }
 
-func (s *Switcher) options(r *http.Request) (engine.Term, error) {
+// TunnelInfo describes a finished tunnel.
+type TunnelInfo struct {
+	ID     xid.ID
+	Remote string
+	Target string
+	User   string
+	Proxy  string
+	TunnelStats
+}
+
+// finish reports the finished tunnel to the log, TunnelFinished, and tunnel_finished/2.
+func (s *Switcher) finish(ctx context.Context, log zerolog.Logger, info TunnelInfo) {
+	log.Info().
+		Int64("sent", info.Sent).
+		Int64("received", info.Received).
+		Dur("handshake", info.Handshake).
+		Dur("duration", info.Duration).
+		Str("reason", info.Reason).
+		Msg("tunnel finish")
+
+	if s.hasTunnelFinished {
+		s.tunnelFinished(ctx, log, info)
+	}
+
+	if s.TunnelFinished != nil {
+		s.TunnelFinished(ctx, info)
+	}
+}
+
+// tunnelFinished queries tunnel_finished(Proxy, Stats) with the finished tunnel.
+func (s *Switcher) tunnelFinished(ctx context.Context, log zerolog.Logger, info TunnelInfo) {
+	stats := engine.List(
+		engine.Atom("rid").Apply(engine.Integer(info.ID.Counter())),
+		engine.Atom("remote").Apply(engine.Atom(info.Remote)),
+		engine.Atom("target").Apply(engine.Atom(info.Target)),
+		engine.Atom("sent").Apply(engine.Integer(info.Sent)),
+		engine.Atom("received").Apply(engine.Integer(info.Received)),
+		engine.Atom("handshake").Apply(engine.Integer(info.Handshake.Milliseconds())),
+		engine.Atom("duration").Apply(engine.Integer(info.Duration.Milliseconds())),
+		engine.Atom("reason").Apply(engine.Atom(info.Reason)),
+	)
+	ctx = context.WithValue(ctx, LogKey, &log)
+	if err := s.QuerySolutionContext(ctx, `tunnel_finished(?, ?).`, engine.Atom(info.Proxy), stats).Err(); err != nil && !errors.Is(err, prolog.ErrNoSolutions) {
+		log.Err(err).Msg("tunnel_finished/2 failed")
+	}
+}
+
+// authorize authenticates the client by Proxy-Authorization header and returns the credentials.
+// If the client fails to authenticate, it replies with an error and returns false.
+func (s *Switcher) authorize(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	log := hlog.FromRequest(r)
+
+	user, password, err := proxyCredentials(r.Header)
+	if err != nil {
+		log.Err(err).Msg("proxyCredentials() failed")
+		http.Error(w, "", http.StatusUnprocessableEntity)
+		return "", "", false
+	}
+
+	ok, err := s.authenticate(context.WithValue(r.Context(), LogKey, log), user, password)
+	if err != nil {
+		log.Err(err).Msg("s.authenticate() failed")
+		http.Error(w, "", http.StatusInternalServerError)
+		return "", "", false
+	}
+	if !ok {
+		log.Info().Str("user", user).Msg("authentication failed")
+		proxyAuthRequired(w)
+		return "", "", false
+	}
+
+	return user, password, true
+}
+
+func (s *Switcher) options(r *http.Request, target, user, password string) (engine.Term, error) {
 	rid, _ := hlog.IDFromRequest(r)
+	return s.optionList(rid, r.RemoteAddr, target, user, password)
+}
 
+// optionList builds Options for tunnel/2 from the request ID, the client address, the target address, and the credentials.
+func (s *Switcher) optionList(rid xid.ID, remote, target, user, password string) (engine.Term, error) {
 	elems := []engine.Term{
 		&engine.Compound{
 			Functor: "rid",
@@ -175,33 +811,100 @@ func (s *Switcher) options(r *http.Request) (engine.Term, error) {
 		&engine.Compound{
 			Functor: "remote",
 			Args: []engine.Term{
-				engine.Atom(r.RemoteAddr),
+				engine.Atom(remote),
 			},
 		},
 		&engine.Compound{
 			Functor: "target",
 			Args: []engine.Term{
-				engine.Atom(r.RequestURI),
+				engine.Atom(target),
 			},
 		},
 	}
 
-	auth := r.Header.Get(proxyAuthorization)
-	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+	if password != "" {
+		elems = append(elems, &engine.Compound{
+			Functor: "password",
+			Args: []engine.Term{
+				engine.Atom(password),
+			},
+		})
+	}
+
+	if user == "" {
 		return engine.List(elems...), nil
 	}
 
-	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
-	if err != nil {
-		return nil, err
+	if s.userinfoTerms {
+		t, err := s.Parser(strings.NewReader(fmt.Sprintf("[%s].", user)), nil).Term()
+		if err != nil {
+			return nil, err
+		}
+		return engine.ListRest(t, elems...), nil
 	}
 
-	i := strings.Index(string(b), ":")
-	t, err := s.Parser(strings.NewReader(fmt.Sprintf("[%s].", string(b[:i]))), nil).Term()
+	opts, err := userOptions(user)
 	if err != nil {
 		return nil, err
 	}
-	return engine.ListRest(t, elems...), nil
+	return engine.List(append(opts, elems...)...), nil
+}
+
+// userOptions decodes a username of the form Option,Option,... into options.
+// Each Option is either Key-Value, which is decoded into a pair, or Tag, which is decoded into an atom.
+// Keys, values, and tags are percent-decoded. Values of decimal digits are decoded into integers.
+func userOptions(user string) ([]engine.Term, error) {
+	var opts []engine.Term
+	for _, e := range strings.Split(user, ",") {
+		if e == "" {
+			continue
+		}
+
+		i := strings.Index(e, "-")
+		if i < 0 {
+			tag, err := url.PathUnescape(e)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, engine.Atom(tag))
+			continue
+		}
+
+		k, err := url.PathUnescape(e[:i])
+		if err != nil {
+			return nil, err
+		}
+		v, err := url.PathUnescape(e[i+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		// Values such as 007 stay atoms since they wouldn't read the same as integers.
+		var value engine.Term = engine.Atom(v)
+		if isDigits(v) {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && strconv.FormatInt(n, 10) == v {
+				value = engine.Integer(n)
+			}
+		}
+
+		opts = append(opts, &engine.Compound{
+			Functor: "-",
+			Args:    []engine.Term{engine.Atom(k), value},
+		})
+	}
+	return opts, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
 }
 
 // ParseURL parses a URL. 'http://' scheme will be assumed if omitted.
@@ -211,3 +914,28 @@ func ParseURL(raw string) (*url.URL, error) {
 	}
 	return url.Parse(raw)
 }
+
+var defaultPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+	"socks4a": "1080",
+}
+
+// urlHostPort returns host:port of u. The port defaults to the one for the scheme.
+func urlHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPorts[u.Scheme])
+}
+
+// upstreamHeader returns the end-to-end part of h with Proxy-Authorization for proxy if it has userinfo.
+func upstreamHeader(h http.Header, proxy *url.URL) http.Header {
+	header := endToEndHeader(h)
+	if proxy.User != nil {
+		header.Set(proxyAuthorization, prefix+base64.StdEncoding.EncodeToString([]byte(proxy.User.String())))
+	}
+	return header
+}
@@ -0,0 +1,470 @@
+package proxima
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ichiban/prolog/engine"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfig writes config to a temporary file and returns the path.
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "config.pl")
+	assert.NoError(t, os.WriteFile(f, []byte(config), 0600))
+	return f
+}
+
+// newTestSwitcher returns a Switcher with config.
+func newTestSwitcher(t *testing.T, config string) *Switcher {
+	t.Helper()
+	s, err := New([]string{writeConfig(t, config)})
+	assert.NoError(t, err)
+	return s
+}
+
+func TestUserOptions(t *testing.T) {
+	t.Run("tags and pairs", func(t *testing.T) {
+		opts, err := userOptions("country-us,session-abc,port-8082,tag")
+		assert.NoError(t, err)
+		assert.Equal(t, []engine.Term{
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("country"), engine.Atom("us")}},
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("session"), engine.Atom("abc")}},
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("port"), engine.Integer(8082)}},
+			engine.Atom("tag"),
+		}, opts)
+	})
+
+	t.Run("leading zeros", func(t *testing.T) {
+		opts, err := userOptions("session-007,port-0,n-99999999999999999999")
+		assert.NoError(t, err)
+		assert.Equal(t, []engine.Term{
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("session"), engine.Atom("007")}},
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("port"), engine.Integer(0)}},
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("n"), engine.Atom("99999999999999999999")}},
+		}, opts)
+	})
+
+	t.Run("percent-encoding", func(t *testing.T) {
+		opts, err := userOptions("city-new%20york,a%2Cb,k%2Dv,x-y-z")
+		assert.NoError(t, err)
+		assert.Equal(t, []engine.Term{
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("city"), engine.Atom("new york")}},
+			engine.Atom("a,b"),
+			engine.Atom("k-v"),
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("x"), engine.Atom("y-z")}},
+		}, opts)
+	})
+
+	t.Run("no injection", func(t *testing.T) {
+		opts, err := userOptions("X),halt,foo(")
+		assert.NoError(t, err)
+		assert.Equal(t, []engine.Term{
+			engine.Atom("X)"),
+			engine.Atom("halt"),
+			engine.Atom("foo("),
+		}, opts)
+	})
+
+	t.Run("invalid percent-encoding", func(t *testing.T) {
+		_, err := userOptions("tag%zz")
+		assert.Error(t, err)
+	})
+}
+
+func TestSwitcher_OptionList(t *testing.T) {
+	rid := xid.New()
+	elems := []engine.Term{
+		&engine.Compound{Functor: "rid", Args: []engine.Term{engine.Integer(rid.Counter())}},
+		&engine.Compound{Functor: "remote", Args: []engine.Term{engine.Atom("127.0.0.1:12345")}},
+		&engine.Compound{Functor: "target", Args: []engine.Term{engine.Atom("example.com:443")}},
+	}
+
+	t.Run("pairs and password", func(t *testing.T) {
+		s, err := New(nil)
+		assert.NoError(t, err)
+
+		opts, err := s.optionList(rid, "127.0.0.1:12345", "example.com:443", "country-us", "secret")
+		assert.NoError(t, err)
+		assert.Equal(t, engine.List(
+			&engine.Compound{Functor: "-", Args: []engine.Term{engine.Atom("country"), engine.Atom("us")}},
+			elems[0], elems[1], elems[2],
+			&engine.Compound{Functor: "password", Args: []engine.Term{engine.Atom("secret")}},
+		), opts)
+	})
+
+	t.Run("terms", func(t *testing.T) {
+		s := newTestSwitcher(t, `userinfo_syntax(terms).`)
+
+		opts, err := s.optionList(rid, "127.0.0.1:12345", "example.com:443", "foo(bar)", "")
+		assert.NoError(t, err)
+
+		var ts []engine.Term
+		iter := engine.ListIterator{List: opts}
+		for iter.Next() {
+			ts = append(ts, iter.Current())
+		}
+		assert.NoError(t, iter.Err())
+		assert.Contains(t, ts, &engine.Compound{Functor: "foo", Args: []engine.Term{engine.Atom("bar")}})
+	})
+}
+
+func TestSwitcher_ServeHTTP_Connect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, target.Close())
+	}()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusProxyAuthRequired)
+	}))
+	defer rejecting.Close()
+	accepting := httptest.NewServer(connectHandler(t))
+	defer accepting.Close()
+
+	connect := func(t *testing.T, s *Switcher, data string) (net.Conn, *bufio.Reader, *http.Response) {
+		srv := httptest.NewServer(s)
+		t.Cleanup(srv.Close)
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assert.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodConnect, "", nil)
+		assert.NoError(t, err)
+		req.Host = target.Addr().String()
+
+		// Send the request and the data following it at once.
+		var b bytes.Buffer
+		assert.NoError(t, req.Write(&b))
+		b.WriteString(data)
+		_, err = conn.Write(b.Bytes())
+		assert.NoError(t, err)
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		assert.NoError(t, err)
+		return conn, br, resp
+	}
+
+	t.Run("fail over", func(t *testing.T) {
+		s := newTestSwitcher(t, fmt.Sprintf("tunnel('%s', _).\ntunnel('%s', _).\n", rejecting.URL, accepting.URL))
+		s.Metrics = NewMetrics()
+
+		conn, br, resp := connect(t, s, "")
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var m bytes.Buffer
+		assert.NoError(t, s.Metrics.WriteText(&m))
+		assert.Contains(t, m.String(), fmt.Sprintf(`proxima_proxy_attempts_total{proxy="%s"} 1`, rejecting.URL))
+		assert.Contains(t, m.String(), fmt.Sprintf(`proxima_proxy_failures_total{proxy="%s",reason="status"} 1`, rejecting.URL))
+		assert.Contains(t, m.String(), fmt.Sprintf(`proxima_proxy_attempts_total{proxy="%s"} 1`, accepting.URL))
+
+		_, err := conn.Write([]byte("hello"))
+		assert.NoError(t, err)
+		b := make([]byte, 5)
+		_, err = io.ReadFull(br, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("pipelined", func(t *testing.T) {
+		conn, br, resp := connect(t, newTestSwitcher(t, fmt.Sprintf("tunnel('%s', _).\n", accepting.URL)), "hello")
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b := make([]byte, 5)
+		_, err = io.ReadFull(br, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+
+	t.Run("no tunnels", func(t *testing.T) {
+		conn, _, resp := connect(t, newTestSwitcher(t, fmt.Sprintf("tunnel('%s', _).\ntunnel('127.0.0.1:1', _).\n", rejecting.URL)), "")
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+	t.Run("tunnel finished", func(t *testing.T) {
+		s := newTestSwitcher(t, fmt.Sprintf(`
+tunnel('%s', _).
+:- dynamic(finished/2).
+tunnel_finished(Proxy, Stats) :- assertz(finished(Proxy, Stats)).
+`, accepting.URL))
+		finished := make(chan TunnelInfo, 1)
+		s.TunnelFinished = func(_ context.Context, info TunnelInfo) {
+			finished <- info
+		}
+
+		conn, br, resp := connect(t, s, "hello")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// The client half-closes and still receives the echo.
+		assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		b, err := ioutil.ReadAll(br)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		assert.NoError(t, conn.Close())
+
+		info := <-finished
+		assert.Equal(t, accepting.URL, info.Proxy)
+		assert.Equal(t, target.Addr().String(), info.Target)
+		assert.Equal(t, int64(5), info.Sent)
+		assert.Equal(t, int64(5), info.Received)
+		assert.Equal(t, ReasonEOF, info.Reason)
+		assert.True(t, info.Handshake <= info.Duration)
+
+		var sol struct {
+			Sent   int
+			Reason string
+		}
+		assert.NoError(t, s.QuerySolution(`finished(_, Stats), member(sent(Sent), Stats), member(reason(Reason), Stats).`).Scan(&sol))
+		assert.Equal(t, 5, sol.Sent)
+		assert.Equal(t, ReasonEOF, sol.Reason)
+	})
+
+	t.Run("drained", func(t *testing.T) {
+		s := newTestSwitcher(t, fmt.Sprintf("tunnel('%s', _).\ntunnel('%s', _).\n", rejecting.URL, accepting.URL))
+		s.Admin = NewAdmin("secret")
+		s.Admin.Drain(rejecting.URL, true)
+
+		conn, _, resp := connect(t, s, "")
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []ProxyState{{Proxy: rejecting.URL, Drained: true, Failures: []Failure{}}}, s.Admin.Proxies())
+	})
+
+	t.Run("circuit open", func(t *testing.T) {
+		s := newTestSwitcher(t, fmt.Sprintf("circuit_breaker(2, 60).\ntunnel('%s', _).\ntunnel('%s', _).\n", rejecting.URL, accepting.URL))
+		s.Metrics = NewMetrics()
+
+		for i := 0; i < 3; i++ {
+			conn, _, resp := connect(t, s, "")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.NoError(t, conn.Close())
+		}
+
+		var m bytes.Buffer
+		assert.NoError(t, s.Metrics.WriteText(&m))
+		assert.Contains(t, m.String(), fmt.Sprintf(`proxima_proxy_attempts_total{proxy="%s"} 2`, rejecting.URL))
+		assert.Contains(t, m.String(), fmt.Sprintf(`proxima_proxy_attempts_total{proxy="%s"} 3`, accepting.URL))
+
+		var sol struct {
+			State string
+		}
+		assert.NoError(t, s.QuerySolution(`circuit(?, State).`, rejecting.URL).Scan(&sol))
+		assert.Equal(t, CircuitOpen, sol.State)
+		assert.NoError(t, s.QuerySolution(`circuit(?, State).`, accepting.URL).Scan(&sol))
+		assert.Equal(t, CircuitClosed, sol.State)
+
+		var stats struct {
+			Rate    float64
+			Latency float64
+		}
+		assert.NoError(t, s.QuerySolution(`proxy_stats(?, Stats), member(failure_rate(Rate), Stats).`, rejecting.URL).Scan(&stats))
+		assert.Equal(t, 1.0, stats.Rate)
+		assert.NoError(t, s.QuerySolution(`proxy_stats(?, Stats), member(failure_rate(Rate), Stats), member(latency(Latency), Stats).`, accepting.URL).Scan(&stats))
+		assert.Equal(t, 0.0, stats.Rate)
+		assert.Greater(t, stats.Latency, 0.0)
+	})
+
+	t.Run("max connections", func(t *testing.T) {
+		another := httptest.NewServer(connectHandler(t))
+		defer another.Close()
+
+		s := newTestSwitcher(t, fmt.Sprintf("max_connections('%s', 1).\ntunnel('%s', _).\ntunnel('%s', _).\n", accepting.URL, accepting.URL, another.URL))
+
+		count := func(proxy string) int {
+			var sol struct {
+				N int
+			}
+			assert.NoError(t, s.QuerySolution(`connections(?, N).`, proxy).Scan(&sol))
+			return sol.N
+		}
+
+		first, _, resp := connect(t, s, "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 1, count(accepting.URL))
+
+		// The first proxy is at capacity.
+		second, _, resp := connect(t, s, "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 1, count(accepting.URL))
+		assert.Equal(t, 1, count(another.URL))
+
+		assert.NoError(t, first.Close())
+		assert.NoError(t, second.Close())
+		assert.Eventually(t, func() bool {
+			return count(accepting.URL) == 0 && count(another.URL) == 0
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("race", func(t *testing.T) {
+		// A black-holed proxy accepts connections but never responds.
+		blackHole, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, blackHole.Close())
+		}()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := blackHole.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}()
+
+		s := newTestSwitcher(t, fmt.Sprintf("race(_, 2).\ntunnel('%s', _).\ntunnel('%s', _).\n", blackHole.Addr(), accepting.URL))
+		s.Metrics = NewMetrics()
+
+		start := time.Now()
+		conn, _, resp := connect(t, s, "")
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+		// The loser is aborted.
+		c := <-accepted
+		defer func() {
+			assert.NoError(t, c.Close())
+		}()
+		assert.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = io.Copy(ioutil.Discard, c)
+		assert.NoError(t, err)
+
+		var m bytes.Buffer
+		assert.NoError(t, s.Metrics.WriteText(&m))
+		assert.NotContains(t, m.String(), "proxima_proxy_failures_total{")
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		s := newTestSwitcher(t, fmt.Sprintf("tunnel('%s', _).\n", accepting.URL))
+		s.Admin = NewAdmin("secret")
+		finished := make(chan TunnelInfo, 1)
+		s.TunnelFinished = func(_ context.Context, info TunnelInfo) {
+			finished <- info
+		}
+
+		conn, br, resp := connect(t, s, "hello")
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b := make([]byte, 5)
+		_, err := io.ReadFull(br, b)
+		assert.NoError(t, err)
+
+		var ts []LiveTunnel
+		assert.Eventually(t, func() bool {
+			ts = s.Admin.Tunnels()
+			return len(ts) == 1 && ts[0].Sent == 5 && ts[0].Received == 5
+		}, 5*time.Second, 100*time.Millisecond)
+		assert.Equal(t, accepting.URL, ts[0].Proxy)
+		assert.Equal(t, target.Addr().String(), ts[0].Target)
+
+		assert.True(t, s.Admin.Kill(ts[0].ID))
+		_, err = br.ReadByte()
+		assert.Equal(t, io.EOF, err)
+
+		info := <-finished
+		assert.Equal(t, ReasonKilled, info.Reason)
+		assert.Empty(t, s.Admin.Tunnels())
+	})
+}
+
+func TestSwitcher_ServeHTTP_Forward(t *testing.T) {
+	forward := func(t *testing.T, s *Switcher, req *http.Request) *http.Response {
+		srv := httptest.NewServer(s)
+		t.Cleanup(srv.Close)
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assert.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		assert.NoError(t, req.WriteProxy(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	t.Run("https without an HTTP proxy", func(t *testing.T) {
+		s := newTestSwitcher(t, "tunnel(direct, _).\n")
+		s.Metrics = NewMetrics()
+
+		req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		assert.NoError(t, err)
+		resp := forward(t, s, req)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		var m bytes.Buffer
+		assert.NoError(t, s.Metrics.WriteText(&m))
+		assert.NotContains(t, m.String(), "proxima_proxy_attempts_total{")
+	})
+
+	t.Run("body already sent", func(t *testing.T) {
+		var bodies []string
+		rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			http.Error(w, "", http.StatusProxyAuthRequired)
+		}))
+		defer rejecting.Close()
+		accepting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("unexpected request")
+		}))
+		defer accepting.Close()
+
+		s := newTestSwitcher(t, fmt.Sprintf("tunnel('%s', _).\ntunnel('%s', _).\n", rejecting.URL, accepting.URL))
+		s.Metrics = NewMetrics()
+
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/", bytes.NewBufferString("hello"))
+		assert.NoError(t, err)
+		resp := forward(t, s, req)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, []string{"hello"}, bodies)
+
+		var m bytes.Buffer
+		assert.NoError(t, s.Metrics.WriteText(&m))
+		assert.Contains(t, m.String(), fmt.Sprintf(`proxima_proxy_attempts_total{proxy="%s"} 1`, rejecting.URL))
+		assert.NotContains(t, m.String(), fmt.Sprintf(`proxima_proxy_attempts_total{proxy="%s"}`, accepting.URL))
+	})
+}
@@ -2,16 +2,66 @@ package proxima
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"sync"
+	"time"
 )
 
+// TunnelStats is the traffic accounting of a tunnel.
+type TunnelStats struct {
+	// Sent is the number of bytes sent from the client to the target.
+	Sent int64
+	// Received is the number of bytes received from the target to the client.
+	Received int64
+	// Handshake is the time taken to establish the connection to the target, e.g. the upstream's response to CONNECT.
+	Handshake time.Duration
+	// Duration is the time from the start of the handshake to the end of the tunnel.
+	Duration time.Duration
+	// Reason is why the tunnel is closed. See ReasonEOF, ReasonIdle, and ReasonError.
+	Reason string
+}
+
+// newTunnelStats builds TunnelStats of a tunnel from inbound, the connection to the upstream, to outbound,
+// the connection to the client.
+func newTunnelStats(start time.Time, handshake time.Duration, stats SpliceStats) TunnelStats {
+	return TunnelStats{
+		Sent:      stats.ToInbound,
+		Received:  stats.ToOutbound,
+		Handshake: handshake,
+		Duration:  time.Since(start),
+		Reason:    stats.Reason,
+	}
+}
+
 // Tunnel connects inbound and outbound connections by making a CONNECT request to inbound.
-func Tunnel(inbound, outbound io.ReadWriteCloser, target net.Addr, header http.Header) error {
+// If inbound is a net.Conn, data sent by inbound right after the response is relayed to outbound as well.
+// It returns the traffic accounting of the tunnel once it's closed.
+func Tunnel(inbound, outbound io.ReadWriteCloser, target net.Addr, header http.Header) (TunnelStats, error) {
+	if c, ok := inbound.(net.Conn); ok {
+		inbound = NewBufferedConn(c, nil)
+	}
+
+	start := time.Now()
+	resp, err := Connect(inbound, target, header)
+	if err != nil {
+		return TunnelStats{}, err
+	}
+	handshake := time.Since(start)
+
+	if err := resp.Write(outbound); err != nil {
+		return TunnelStats{}, err
+	}
+
+	return newTunnelStats(start, handshake, Splice(inbound, outbound)), nil
+}
+
+// Connect makes a CONNECT request to inbound and returns the successful response.
+// If inbound is a *BufferedConn, data sent by inbound right after the response is kept in its buffer. Otherwise, it may be lost.
+func Connect(inbound io.ReadWriter, target net.Addr, header http.Header) (*http.Response, error) {
 	req := http.Request{
 		Method: http.MethodConnect,
 		URL: &url.URL{
@@ -21,42 +71,116 @@ func Tunnel(inbound, outbound io.ReadWriteCloser, target net.Addr, header http.H
 	}
 
 	if err := req.Write(inbound); err != nil {
-		return err
+		return nil, err
 	}
 
-	br := bufio.NewReader(inbound)
-	resp, err := http.ReadResponse(br, &req)
+	resp, err := http.ReadResponse(bufferedReader(inbound), &req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_ = resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("status is not 2XX: %s", resp.Status)
+		return nil, &StatusError{Status: resp.Status, StatusCode: resp.StatusCode}
 	}
 
-	if err := resp.Write(outbound); err != nil {
-		return err
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer func() {
-			_ = inbound.Close()
-		}()
-		_, _ = io.Copy(inbound, outbound)
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer func() {
-			_ = outbound.Close()
-		}()
-		_, _ = io.Copy(outbound, inbound)
-	}()
-	wg.Wait()
-
-	return nil
+	// Whatever follows a 2XX response to CONNECT is tunneled data, not the body.
+	// See https://datatracker.ietf.org/doc/html/rfc7231#section-4.3.6
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+	resp.TransferEncoding = nil
+
+	return resp, nil
+}
+
+// StatusError is a non-2XX response to CONNECT.
+type StatusError struct {
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status is not 2XX: %s", e.Status)
+}
+
+// Handshake asks the proxy connected via inbound to connect to target by the protocol indicated by the scheme of proxy.
+// For HTTP proxies, header is sent along with the CONNECT request.
+// It returns the response to relay to HTTP clients, which is made up for non-HTTP proxies.
+func Handshake(inbound io.ReadWriter, proxy *url.URL, target net.Addr, header http.Header) (*http.Response, error) {
+	return HandshakeContext(context.Background(), inbound, proxy, target, header)
+}
+
+// HandshakeContext is the same as Handshake except that ctx bounds resolving target locally for socks5 proxies.
+func HandshakeContext(ctx context.Context, inbound io.ReadWriter, proxy *url.URL, target net.Addr, header http.Header) (*http.Response, error) {
+	switch proxy.Scheme {
+	case "http", "https":
+		return Connect(inbound, target, upstreamHeader(header, proxy))
+	case "socks5":
+		if err := socks5Connect(ctx, inbound, proxy.User, target, true); err != nil {
+			return nil, err
+		}
+	case "socks5h":
+		if err := socks5Connect(ctx, inbound, proxy.User, target, false); err != nil {
+			return nil, err
+		}
+	case "socks4a":
+		if err := socks4aConnect(inbound, proxy.User, target); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxy.Scheme)
+	}
+	return connectionEstablished(), nil
+}
+
+// connectionEstablished returns a made-up response to a successful CONNECT request.
+func connectionEstablished() *http.Response {
+	return &http.Response{
+		Status:     "200 Connection established",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+}
+
+// BufferedConn is a connection which reads through a buffer so that data read ahead into the buffer isn't lost.
+type BufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewBufferedConn returns a connection which reads from r first and then conn. If r is nil, a new buffer of conn is used.
+func NewBufferedConn(conn net.Conn, r *bufio.Reader) *BufferedConn {
+	if c, ok := conn.(*BufferedConn); ok && r == nil {
+		return c
+	}
+	if r == nil {
+		r = bufio.NewReader(conn)
+	}
+	return &BufferedConn{Conn: conn, r: r}
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// bufferedReader returns the buffer of r if r is a *BufferedConn. Otherwise, it returns a new buffer of r.
+func bufferedReader(r io.Reader) *bufio.Reader {
+	if c, ok := r.(*BufferedConn); ok {
+		return c.r
+	}
+	return bufio.NewReader(r)
+}
+
+// TargetAddr is an address of the form host:port which is resolved remotely by proxies if host is a domain name.
+type TargetAddr string
+
+// Network returns "tcp".
+func (a TargetAddr) Network() string {
+	return "tcp"
+}
+
+func (a TargetAddr) String() string {
+	return string(a)
 }
@@ -2,6 +2,7 @@ package proxima
 
 import (
 	"bufio"
+	"io"
 	"net"
 	"net/http"
 	"testing"
@@ -45,7 +46,47 @@ func TestTunnel(t *testing.T) {
 			assert.NoError(t, outc.Close())
 		}()
 
-		assert.NoError(t, Tunnel(inc, outc, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil))
+		_, err := Tunnel(inc, outc, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil)
+		assert.NoError(t, err)
+	})
+
+	t.Run("inbound sends data right after the response", func(t *testing.T) {
+		ins, inc := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, ins.Close())
+			}()
+
+			req, err := http.ReadRequest(bufio.NewReader(ins))
+			assert.NoError(t, err)
+			assert.Equal(t, http.MethodConnect, req.Method)
+
+			_, err = ins.Write([]byte("HTTP/1.1 200 OK\r\n\r\nhello"))
+			assert.NoError(t, err)
+		}()
+
+		outs, outc := net.Pipe()
+		go func() {
+			defer func() {
+				assert.NoError(t, outs.Close())
+			}()
+
+			br := bufio.NewReader(outs)
+			resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			b := make([]byte, 5)
+			_, err = io.ReadFull(br, b)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(b))
+		}()
+
+		stats, err := Tunnel(inc, outc, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), stats.Sent)
+		assert.Equal(t, int64(5), stats.Received)
+		assert.Equal(t, ReasonEOF, stats.Reason)
 	})
 
 	t.Run("inbound doesn't accept a CONNECT request", func(t *testing.T) {
@@ -59,7 +100,8 @@ func TestTunnel(t *testing.T) {
 			assert.NoError(t, inc.Close())
 		}()
 
-		assert.Error(t, Tunnel(inc, nil, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil))
+		_, err := Tunnel(inc, nil, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil)
+		assert.Error(t, err)
 	})
 
 	t.Run("inbound doesn't reply to a CONNECT request", func(t *testing.T) {
@@ -77,7 +119,8 @@ func TestTunnel(t *testing.T) {
 			assert.NoError(t, inc.Close())
 		}()
 
-		assert.Error(t, Tunnel(inc, nil, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil))
+		_, err := Tunnel(inc, nil, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil)
+		assert.Error(t, err)
 	})
 
 	t.Run("inbound responds with a non-2XX status code", func(t *testing.T) {
@@ -98,7 +141,8 @@ func TestTunnel(t *testing.T) {
 			assert.NoError(t, inc.Close())
 		}()
 
-		assert.Error(t, Tunnel(inc, nil, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil))
+		_, err := Tunnel(inc, nil, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil)
+		assert.Error(t, err)
 	})
 
 	t.Run("outbound doesn't accept a response", func(t *testing.T) {
@@ -132,6 +176,7 @@ func TestTunnel(t *testing.T) {
 			assert.NoError(t, outc.Close())
 		}()
 
-		assert.Error(t, Tunnel(inc, outc, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil))
+		_, err := Tunnel(inc, outc, &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 8080}, nil)
+		assert.Error(t, err)
 	})
 }